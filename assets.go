@@ -20,6 +20,8 @@ func Run() {
 			os.Exit(1)
 		}
 		Upstreams[name] = upstream
+		go upstream.Migrator()
+		go upstream.Sweeper()
 	}
 	Listen()
 }
@@ -0,0 +1,105 @@
+package assets
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUTH_BEARER      = "bearer"
+	AUTH_BASIC       = "basic"
+	AUTH_BEARER_FILE = "bearer_file"
+
+	// how often a token file is checked for changes
+	AUTH_FILE_CHECK = time.Second
+)
+
+// Provides the Authorization header for requests to the upstream. The value
+// is a secret, it must never be logged.
+type Authenticator interface {
+	Authorization() (string, error)
+}
+
+func NewAuthenticator(config *upstreamAuthConfig) Authenticator {
+	if config == nil {
+		return nil
+	}
+
+	switch config.Type {
+	case AUTH_BEARER:
+		return staticAuth("Bearer " + config.Token)
+	case AUTH_BASIC:
+		credentials := config.Username + ":" + config.Password
+		return staticAuth("Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)))
+	case AUTH_BEARER_FILE:
+		return &fileAuth{path: config.TokenFile}
+	}
+	return nil
+}
+
+type staticAuth string
+
+func (a staticAuth) Authorization() (string, error) {
+	return string(a), nil
+}
+
+// A bearer token read from a file (say, one which is rotated by another
+// process). The file is re-read whenever it changes.
+type fileAuth struct {
+	sync.Mutex
+	path      string
+	value     string
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+func (a *fileAuth) Authorization() (string, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	if a.value != "" && now.Sub(a.lastCheck) < AUTH_FILE_CHECK {
+		return a.value, nil
+	}
+	a.lastCheck = now
+
+	stat, err := os.Stat(a.path)
+	if err != nil {
+		if a.value != "" {
+			// keep using the token we have, it might still be valid
+			return a.value, nil
+		}
+		return "", err
+	}
+
+	if a.value != "" && stat.ModTime().Equal(a.modTime) && stat.Size() == a.size {
+		return a.value, nil
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		if a.value != "" {
+			return a.value, nil
+		}
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		if a.value != "" {
+			// probably caught the file mid-write
+			return a.value, nil
+		}
+		return "", errors.New("token file is empty")
+	}
+
+	a.value = "Bearer " + token
+	a.modTime = stat.ModTime()
+	a.size = stat.Size()
+	return a.value, nil
+}
@@ -0,0 +1,57 @@
+package assets
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_Authenticator_None(t *testing.T) {
+	assert.Nil(t, NewAuthenticator(nil))
+}
+
+func Test_Authenticator_Bearer(t *testing.T) {
+	auth := NewAuthenticator(&upstreamAuthConfig{Type: AUTH_BEARER, Token: "secret"})
+	value, err := auth.Authorization()
+	assert.Nil(t, err)
+	assert.Equal(t, value, "Bearer secret")
+}
+
+func Test_Authenticator_Basic(t *testing.T) {
+	auth := NewAuthenticator(&upstreamAuthConfig{Type: AUTH_BASIC, Username: "leto", Password: "ghanima"})
+	value, err := auth.Authorization()
+	assert.Nil(t, err)
+	assert.Equal(t, value, "Basic bGV0bzpnaGFuaW1h")
+}
+
+func Test_Authenticator_BearerFile(t *testing.T) {
+	tokenFile := path.Join(t.TempDir(), "token")
+	auth := NewAuthenticator(&upstreamAuthConfig{Type: AUTH_BEARER_FILE, TokenFile: tokenFile})
+
+	_, err := auth.Authorization()
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("t1\n"), 0600))
+	value, err := auth.Authorization()
+	assert.Nil(t, err)
+	assert.Equal(t, value, "Bearer t1")
+
+	// changed, but we only check every AUTH_FILE_CHECK
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("t22"), 0600))
+	value, _ = auth.Authorization()
+	assert.Equal(t, value, "Bearer t1")
+
+	auth.(*fileAuth).lastCheck = time.Time{}
+	value, _ = auth.Authorization()
+	assert.Equal(t, value, "Bearer t22")
+
+	// keeps the last good token
+	assert.Nil(t, os.Remove(tokenFile))
+	auth.(*fileAuth).lastCheck = time.Time{}
+	value, err = auth.Authorization()
+	assert.Nil(t, err)
+	assert.Equal(t, value, "Bearer t22")
+}
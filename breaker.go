@@ -0,0 +1,200 @@
+package assets
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half_open"
+	BREAKER_DISABLED  = "disabled"
+)
+
+var errCircuitOpen = errors.New("Upstream circuit breaker is open")
+
+// Stops us from sending requests to an upstream which is failing. The breaker
+// opens once, within a window, there have been too many failures (or too high
+// a rate of failures). While open, requests fail immediately. After the
+// cooldown, a single probe request is let through (half-open): if it succeeds
+// the breaker closes, else it opens for another cooldown. A nil
+// *CircuitBreaker is valid and never opens (the upstream has no breaker).
+type CircuitBreaker struct {
+	sync.Mutex
+	state string
+
+	// open once we've seen this many failures within the window (0 == never)
+	failures int
+	// or once this fraction of requests, within the window, failed (0 == never)
+	errorRate float64
+	// errorRate only applies once we've seen this many requests in the window
+	minRequests int
+
+	window   time.Duration
+	cooldown time.Duration
+
+	// the current window
+	windowStart     time.Time
+	windowRequests  int
+	windowFailures  int
+	openedAt        time.Time
+	probeInProgress bool
+}
+
+// A snapshot of the breaker's state, for /info
+type BreakerStatus struct {
+	State    string     `json:"state"`
+	Requests int        `json:"requests,omitempty"`
+	Failures int        `json:"failures,omitempty"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+func NewCircuitBreaker(config *upstreamBreakerConfig) *CircuitBreaker {
+	if config == nil || (config.Failures <= 0 && config.ErrorRate <= 0) {
+		return nil
+	}
+
+	window := config.Window
+	if window <= 0 {
+		window = 30
+	}
+	cooldown := config.Cooldown
+	if cooldown <= 0 {
+		cooldown = 15
+	}
+	minRequests := config.MinRequests
+	if minRequests <= 0 {
+		minRequests = 20
+	}
+
+	return &CircuitBreaker{
+		state:       BREAKER_CLOSED,
+		failures:    config.Failures,
+		errorRate:   config.ErrorRate,
+		minRequests: minRequests,
+		window:      time.Duration(window) * time.Second,
+		cooldown:    time.Duration(cooldown) * time.Second,
+		windowStart: time.Now(),
+	}
+}
+
+// Whether a request can be sent to the upstream. Every allowed request must
+// be followed by a call to Record.
+func (b *CircuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case BREAKER_CLOSED:
+		return true
+	case BREAKER_OPEN:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BREAKER_HALF_OPEN
+		b.probeInProgress = true
+		return true
+	default:
+		// half open, only one probe at a time
+		if b.probeInProgress {
+			return false
+		}
+		b.probeInProgress = true
+		return true
+	}
+}
+
+func (b *CircuitBreaker) Record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	if b.state == BREAKER_HALF_OPEN {
+		b.probeInProgress = false
+		if failed {
+			b.open(now)
+		} else {
+			b.state = BREAKER_CLOSED
+			b.resetWindow(now)
+		}
+		return
+	}
+
+	if b.state == BREAKER_OPEN {
+		// a request which was allowed before we opened
+		return
+	}
+
+	if now.Sub(b.windowStart) > b.window {
+		b.resetWindow(now)
+	}
+
+	b.windowRequests += 1
+	if !failed {
+		return
+	}
+	b.windowFailures += 1
+
+	if b.failures > 0 && b.windowFailures >= b.failures {
+		b.open(now)
+		return
+	}
+
+	if b.errorRate > 0 && b.windowRequests >= b.minRequests {
+		if float64(b.windowFailures)/float64(b.windowRequests) >= b.errorRate {
+			b.open(now)
+		}
+	}
+}
+
+// True when the breaker is open or half-open
+func (b *CircuitBreaker) IsOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.state != BREAKER_CLOSED
+}
+
+func (b *CircuitBreaker) Status() BreakerStatus {
+	if b == nil {
+		return BreakerStatus{State: BREAKER_DISABLED}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	status := BreakerStatus{
+		State:    b.state,
+		Requests: b.windowRequests,
+		Failures: b.windowFailures,
+	}
+	if b.state != BREAKER_CLOSED {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+func (b *CircuitBreaker) open(now time.Time) {
+	b.state = BREAKER_OPEN
+	b.openedAt = now
+	b.resetWindow(now)
+}
+
+func (b *CircuitBreaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.windowRequests = 0
+	b.windowFailures = 0
+}
@@ -0,0 +1,78 @@
+package assets
+
+import (
+	"testing"
+	"time"
+
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_CircuitBreaker_Disabled(t *testing.T) {
+	var b *CircuitBreaker
+	assert.Nil(t, NewCircuitBreaker(nil))
+	assert.Nil(t, NewCircuitBreaker(&upstreamBreakerConfig{Window: 10}))
+
+	b.Record(true)
+	assert.True(t, b.Allow())
+	assert.False(t, b.IsOpen())
+	assert.Equal(t, b.Status().State, BREAKER_DISABLED)
+}
+
+func Test_CircuitBreaker_Failures(t *testing.T) {
+	b := NewCircuitBreaker(&upstreamBreakerConfig{Failures: 3})
+	for i := 0; i < 2; i++ {
+		assert.True(t, b.Allow())
+		b.Record(true)
+	}
+	b.Record(false)
+	assert.Equal(t, b.Status().State, BREAKER_CLOSED)
+
+	b.Record(true)
+	assert.Equal(t, b.Status().State, BREAKER_OPEN)
+	assert.True(t, b.IsOpen())
+	assert.False(t, b.Allow())
+}
+
+func Test_CircuitBreaker_Window(t *testing.T) {
+	b := NewCircuitBreaker(&upstreamBreakerConfig{Failures: 2})
+	b.Record(true)
+	b.windowStart = time.Now().Add(-time.Minute)
+	b.Record(true)
+	assert.Equal(t, b.Status().State, BREAKER_CLOSED)
+	assert.Equal(t, b.Status().Failures, 1)
+}
+
+func Test_CircuitBreaker_ErrorRate(t *testing.T) {
+	b := NewCircuitBreaker(&upstreamBreakerConfig{ErrorRate: 0.5, MinRequests: 4})
+	b.Record(true)
+	b.Record(true)
+	b.Record(false)
+	// not enough requests yet
+	assert.Equal(t, b.Status().State, BREAKER_CLOSED)
+
+	b.Record(true)
+	assert.Equal(t, b.Status().State, BREAKER_OPEN)
+}
+
+func Test_CircuitBreaker_HalfOpen(t *testing.T) {
+	b := NewCircuitBreaker(&upstreamBreakerConfig{Failures: 1, Cooldown: 60})
+	b.Record(true)
+	assert.False(t, b.Allow())
+
+	// cooldown over, a single probe goes through
+	b.openedAt = time.Now().Add(-time.Minute)
+	assert.True(t, b.Allow())
+	assert.Equal(t, b.Status().State, BREAKER_HALF_OPEN)
+	assert.False(t, b.Allow())
+
+	// failed probe, open again
+	b.Record(true)
+	assert.Equal(t, b.Status().State, BREAKER_OPEN)
+	assert.False(t, b.Allow())
+
+	b.openedAt = time.Now().Add(-time.Minute)
+	assert.True(t, b.Allow())
+	b.Record(false)
+	assert.Equal(t, b.Status().State, BREAKER_CLOSED)
+	assert.True(t, b.Allow())
+}
@@ -1,9 +1,26 @@
 package assets
 
 import (
+	"container/list"
 	"hash/fnv"
+	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"src.goblgobl.com/utils/log"
+)
+
+const (
+	// seconds between updates to a cache file's mtime when it's used (see
+	// DiskCache)
+	DISK_CACHE_TOUCH_INTERVAL = 60
+
+	// seconds an image without a meta has to have existed for before we
+	// consider it left behind by a crash (see mayBeOrphanImage)
+	ORPHAN_IMAGE_AGE = 3600
 )
 
 type NotFoundCache struct {
@@ -43,6 +60,10 @@ func (c *NotFoundCache) Set(path string, ttl uint32) {
 	c.bucket(path).set(path, ttl)
 }
 
+func (c *NotFoundCache) Delete(path string) bool {
+	return c.bucket(path).delete(path)
+}
+
 func (c *NotFoundCache) bucket(path string) *NotFoundCacheBucket {
 	h := fnv.New32a()
 	h.Write([]byte(path))
@@ -84,6 +105,14 @@ func (b *NotFoundCacheBucket) get(path string) bool {
 	return false
 }
 
+func (b *NotFoundCacheBucket) delete(path string) bool {
+	defer b.Unlock()
+	b.Lock()
+	_, exists := b.items[path]
+	delete(b.items, path)
+	return exists
+}
+
 func (b *NotFoundCacheBucket) set(path string, ttl uint32) {
 	max := b.max
 	expires := uint32(time.Now().Unix()) + ttl
@@ -105,3 +134,232 @@ func (b *NotFoundCacheBucket) set(path string, ttl uint32) {
 		}
 	}
 }
+
+// Tracks the disk usage of an upstream's cache and evicts the least recently
+// used entries once max bytes is exceeded. An entry is keyed by its .res file
+// and its size includes the paired image file (if any). A nil *DiskCache is
+// valid and does nothing (the upstream has no max_cache_bytes).
+//
+// Recency survives a restart through the .res file's mtime, which Touch
+// updates (at most once every DISK_CACHE_TOUCH_INTERVAL seconds per entry)
+// and Load orders by. This only applies to stores backed by the filesystem.
+type DiskCache struct {
+	sync.Mutex
+	store   Store
+	max     int64
+	size    int64
+	list    *list.List
+	entries map[string]*list.Element
+
+	// called with the path of every evicted entry
+	onEvict func(path string)
+}
+
+type diskCacheEntry struct {
+	path string
+	size int64
+	// unix seconds when the file's mtime was last set
+	touched int64
+}
+
+func NewDiskCache(store Store, max int64) *DiskCache {
+	if max <= 0 {
+		return nil
+	}
+	return &DiskCache{
+		max:     max,
+		store:   store,
+		list:    list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Lists root and registers every existing .res file (and its image), oldest
+// first, so that a restart doesn't forget what's in the store. Images without
+// a .res file are removed (see mayBeOrphanImage).
+func (c *DiskCache) Load(root string) error {
+	if c == nil {
+		return nil
+	}
+
+	type existing struct {
+		path    string
+		modTime int64
+	}
+
+	var metas []existing
+	var images []string
+	now := time.Now()
+	sizes := make(map[string]int64)
+	err := c.store.List(root, func(p string, info StoreInfo) error {
+		sizes[p] = info.Size
+		if strings.HasSuffix(p, ".res") {
+			metas = append(metas, existing{path: p, modTime: info.ModTime.UnixNano()})
+		} else if mayBeOrphanImage(p, info, now) {
+			images = append(images, p)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, p := range images {
+		if _, exists := sizes[p+".res"]; exists {
+			continue
+		}
+		if err := c.store.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Error("DiskCache.Load.orphan").String("path", p).Err(err).Log()
+		}
+	}
+
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].modTime < metas[j].modTime
+	})
+
+	for _, m := range metas {
+		// an image's size is included in its meta's entry (a static
+		// response won't have an "image", so this will just be 0)
+		c.add(m.path, sizes[m.path]+sizes[m.path[:len(m.path)-4]], m.modTime/int64(time.Second))
+	}
+	return nil
+}
+
+func (c *DiskCache) OnEvict(fn func(path string)) {
+	if c == nil {
+		return
+	}
+	c.onEvict = fn
+}
+
+// Registers (or re-registers) a cache file as the most recently used entry
+// and evicts older entries if we're now over our limit.
+func (c *DiskCache) Add(path string, size int64) {
+	if c == nil {
+		return
+	}
+	// the file was just written
+	c.add(path, size, time.Now().Unix())
+}
+
+func (c *DiskCache) add(path string, size int64, touched int64) {
+	c.Lock()
+	if element, exists := c.entries[path]; exists {
+		entry := element.Value.(*diskCacheEntry)
+		c.size += size - entry.size
+		entry.size = size
+		entry.touched = touched
+		c.list.MoveToFront(element)
+	} else {
+		c.entries[path] = c.list.PushFront(&diskCacheEntry{path: path, size: size, touched: touched})
+		c.size += size
+	}
+	evict := c.evictable()
+	c.Unlock()
+
+	for _, p := range evict {
+		if _, err := removeCacheFiles(c.store, p); err != nil {
+			log.Error("DiskCache.evict").String("path", p).Err(err).Log()
+		}
+		if c.onEvict != nil {
+			c.onEvict(p)
+		}
+	}
+}
+
+// Marks the entry as recently used
+func (c *DiskCache) Touch(path string) {
+	if c == nil {
+		return
+	}
+
+	persist := false
+	now := time.Now()
+	c.Lock()
+	if element, exists := c.entries[path]; exists {
+		c.list.MoveToFront(element)
+		entry := element.Value.(*diskCacheEntry)
+		if now.Unix()-entry.touched >= DISK_CACHE_TOUCH_INTERVAL {
+			entry.touched = now.Unix()
+			persist = true
+		}
+	}
+	c.Unlock()
+
+	if persist {
+		if fileStore, ok := c.store.(FileStore); ok {
+			// the file could have been removed since, that's fine
+			os.Chtimes(fileStore.FilePath(path), now, now)
+		}
+	}
+}
+
+// Forgets about an entry which has been removed from disk
+func (c *DiskCache) Remove(path string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	if element, exists := c.entries[path]; exists {
+		c.size -= element.Value.(*diskCacheEntry).size
+		c.list.Remove(element)
+		delete(c.entries, path)
+	}
+	c.Unlock()
+}
+
+func (c *DiskCache) Size() int64 {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.size
+}
+
+// Must be called under lock. Returns the paths that were removed from the list
+// and that the caller should delete from disk (we don't want to do disk IO
+// while holding the lock). We never evict the most recently used entry,
+// even if it alone is larger than our max.
+func (c *DiskCache) evictable() []string {
+	var evict []string
+	l := c.list
+	for c.size > c.max && l.Len() > 1 {
+		element := l.Back()
+		entry := element.Value.(*diskCacheEntry)
+		l.Remove(element)
+		delete(c.entries, entry.path)
+		c.size -= entry.size
+		evict = append(evict, entry.path)
+	}
+	return evict
+}
+
+// Whether p could be an image whose meta doesn't exist (which our caller has
+// to check). The meta is committed after its image, so a crash in between
+// leaves the image behind, where nothing would ever count, evict or sweep it.
+// Recent images are left alone, their meta could still be on its way.
+func mayBeOrphanImage(p string, info StoreInfo, now time.Time) bool {
+	if strings.HasSuffix(p, ".res") || !isImageExtension(path.Ext(p)) {
+		return false
+	}
+	return now.Sub(info.ModTime) >= ORPHAN_IMAGE_AGE*time.Second
+}
+
+// Removes a .res file and, if it's the meta of an image, the image itself
+// (the image path is the meta path without the trailing .res).
+// Returns true if the .res file existed.
+func removeCacheFiles(store Store, metaPath string) (bool, error) {
+	existed := true
+	if err := store.Remove(metaPath); err != nil {
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+		existed = false
+	}
+	if err := store.Remove(metaPath[:len(metaPath)-4]); err != nil && !os.IsNotExist(err) {
+		return existed, err
+	}
+	return existed, nil
+}
@@ -1,8 +1,11 @@
 package assets
 
 import (
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 
 	"src.goblgobl.com/tests/assert"
 )
@@ -18,6 +21,15 @@ func Test_NotFoundCache_GetAndSet(t *testing.T) {
 	assert.False(t, c.Get("a path"))
 }
 
+func Test_NotFoundCache_Delete(t *testing.T) {
+	c := NewNotFoundCache(100)
+	assert.False(t, c.Delete("a path"))
+
+	c.Set("a path", 3)
+	assert.True(t, c.Delete("a path"))
+	assert.False(t, c.Get("a path"))
+}
+
 func Test_NotFoundCache_LimitsSize(t *testing.T) {
 	c := NewNotFoundCache(160)
 	for i := 0; i < 500; i++ {
@@ -28,3 +40,118 @@ func Test_NotFoundCache_LimitsSize(t *testing.T) {
 		assert.True(t, l < 16)
 	}
 }
+
+func Test_DiskCache_Disabled(t *testing.T) {
+	c := NewDiskCache(DiskStore{}, 0)
+	assert.Nil(t, c)
+
+	// nil cache is a noop
+	c.Add("a.res", 10)
+	c.Touch("a.res")
+	c.Remove("a.res")
+	assert.Equal(t, c.Size(), 0)
+}
+
+func Test_DiskCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	root := t.TempDir()
+	p1 := writeDiskCacheFile(root, "a.css.res", 10)
+	p2 := writeDiskCacheFile(root, "b.png.res", 10)
+	writeDiskCacheFile(root, "b.png", 5)
+	p3 := writeDiskCacheFile(root, "c.css.res", 10)
+
+	var evicted []string
+	c := NewDiskCache(DiskStore{}, 30)
+	c.OnEvict(func(path string) { evicted = append(evicted, path) })
+	c.Add(p1, 10)
+	c.Add(p2, 15)
+	assert.Equal(t, c.Size(), 25)
+
+	// p1 is now more recently used than p2
+	c.Touch(p1)
+	c.Add(p3, 10)
+	assert.Equal(t, c.Size(), 20)
+
+	assert.True(t, fileExists(p1))
+	assert.False(t, fileExists(p2))
+	assert.False(t, fileExists(p2[:len(p2)-4]))
+	assert.True(t, fileExists(p3))
+	assert.Equal(t, len(evicted), 1)
+	assert.Equal(t, evicted[0], p2)
+
+	c.Remove(p1)
+	assert.Equal(t, c.Size(), 10)
+}
+
+func Test_DiskCache_Load(t *testing.T) {
+	root := t.TempDir()
+	writeDiskCacheFile(root, "aa/a.css.res", 10)
+	writeDiskCacheFile(root, "bb/b.png.res", 20)
+	writeDiskCacheFile(root, "bb/b.png", 30)
+
+	c := NewDiskCache(DiskStore{}, 1000)
+	assert.Nil(t, c.Load(root))
+	assert.Equal(t, c.Size(), 60)
+}
+
+func Test_DiskCache_Load_OrphanImages(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	orphan := writeDiskCacheFile(root, "aa/a.png", 10)
+	image := writeDiskCacheFile(root, "bb/b.png", 20)
+	meta := writeDiskCacheFile(root, "bb/b.png.res", 5)
+	recent := writeDiskCacheFile(root, "cc/c.png", 40)
+	index := writeDiskCacheFile(root, "tags.idx", 80)
+	for _, p := range []string{orphan, image, meta, index} {
+		os.Chtimes(p, old, old)
+	}
+
+	c := NewDiskCache(DiskStore{}, 1000)
+	assert.Nil(t, c.Load(root))
+	assert.Equal(t, c.Size(), 25)
+	assert.False(t, fileExists(orphan))
+	assert.True(t, fileExists(image))
+	// its meta could still be on its way
+	assert.True(t, fileExists(recent))
+	assert.True(t, fileExists(index))
+}
+
+func Test_DiskCache_TouchSurvivesRestart(t *testing.T) {
+	root := t.TempDir()
+	p1 := writeDiskCacheFile(root, "aa/a.css.res", 10)
+	p2 := writeDiskCacheFile(root, "bb/b.css.res", 10)
+	older, old := time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)
+	os.Chtimes(p1, older, older)
+	os.Chtimes(p2, old, old)
+
+	c := NewDiskCache(DiskStore{}, 1000)
+	assert.Nil(t, c.Load(root))
+	c.Touch(p1)
+
+	// after a restart, p1 is still more recently used than p2
+	c = NewDiskCache(DiskStore{}, 25)
+	assert.Nil(t, c.Load(root))
+	c.Add(writeDiskCacheFile(root, "cc/c.css.res", 10), 10)
+	assert.True(t, fileExists(p1))
+	assert.False(t, fileExists(p2))
+
+	// touches are throttled: p1 was loaded with a recent mtime, so it's left
+	// alone
+	os.Chtimes(p1, older, older)
+	c.Touch(p1)
+	info, _ := os.Stat(p1)
+	assert.Equal(t, info.ModTime().Unix(), older.Unix())
+}
+
+func writeDiskCacheFile(root string, name string, size int) string {
+	p := filepath.Join(root, name)
+	os.MkdirAll(filepath.Dir(p), 0700)
+	if err := os.WriteFile(p, make([]byte, size), 0600); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"src.goblgobl.com/assets"
+)
+
+const cacheUsage = `usage: assets cache <command> [flags] [args]
+
+commands:
+  ls                 list every cached entry
+  show <path>...     details of the cached entries for a remote path
+                     (all transforms included) or for a .res cache file
+  stat               totals for the upstream's cache
+
+flags:
+`
+
+// assets cache ls|show|stat
+func cacheCommand(args []string) int {
+	command := ""
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet("cache "+command, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), cacheUsage)
+		flags.PrintDefaults()
+	}
+	configPath := flags.String("config", "config.json", "full path to config file")
+	upstreamName := flags.String("upstream", "", "upstream to inspect (optional when only one is configured)")
+	asJSON := flags.Bool("json", false, "output JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var run func(cache *assets.CacheReader, args []string, asJSON bool) error
+	switch command {
+	case "ls":
+		run = cacheLs
+	case "show":
+		run = cacheShow
+	case "stat":
+		run = cacheStat
+	default:
+		if command != "" {
+			fmt.Fprintf(os.Stderr, "unknown cache command: %s\n\n", command)
+		}
+		flags.Usage()
+		return 2
+	}
+
+	if err := assets.Configure(*configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config (%s): %s\n", *configPath, err)
+		return 1
+	}
+
+	name, err := resolveUpstream(*upstreamName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// not a full upstream, which would modify the cache as it loads it
+	cache := assets.NewCacheReader(name, assets.Config.Upstreams[name])
+	if err := run(cache, flags.Args(), *asJSON); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// The name of the configured upstream, which can be omitted when there's
+// only one
+func resolveUpstream(name string) (string, error) {
+	upstreams := assets.Config.Upstreams
+	if name == "" {
+		if len(upstreams) != 1 {
+			names := make([]string, 0, len(upstreams))
+			for name := range upstreams {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return "", fmt.Errorf("-upstream is required, configured upstreams: %s", strings.Join(names, ", "))
+		}
+		for n := range upstreams {
+			name = n
+		}
+	}
+
+	if _, exists := upstreams[name]; !exists {
+		return "", fmt.Errorf("unknown upstream: %s", name)
+	}
+	return name, nil
+}
+
+func cacheLs(cache *assets.CacheReader, args []string, asJSON bool) error {
+	if asJSON {
+		// one entry per line, so that the output can be streamed / grepped
+		encoder := json.NewEncoder(os.Stdout)
+		return cache.ListCache(func(entry assets.CacheEntry) error {
+			entry.Headers = nil
+			return encoder.Encode(entry)
+		})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tTYPE\tEXPIRES\tSIZE\tCONTENT TYPE\tREMOTE PATH")
+	err := cache.ListCache(func(entry assets.CacheEntry) error {
+		_, err := fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n", entry.Status, entry.Type, formatExpires(entry), entry.Size, entry.ContentType, formatRemotePath(entry))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func cacheShow(cache *assets.CacheReader, args []string, asJSON bool) error {
+	if len(args) == 0 {
+		return errors.New("show requires at least one remote path or cache file")
+	}
+
+	entries := make([]assets.CacheEntry, 0, len(args))
+	for _, arg := range args {
+		paths := []string{arg}
+		if !strings.HasSuffix(arg, ".res") {
+			paths = cache.CachePaths(arg)
+		}
+
+		for _, p := range paths {
+			entry, err := cache.InspectCache(p)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	if len(entries) == 0 {
+		return errors.New("not cached")
+	}
+	for i, entry := range entries {
+		if i > 0 {
+			fmt.Println()
+		}
+		printEntry(os.Stdout, entry)
+	}
+	return nil
+}
+
+func cacheStat(cache *assets.CacheReader, args []string, asJSON bool) error {
+	stats, err := cache.CacheStats()
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "entries:\t%d\n", stats.Entries)
+	fmt.Fprintf(w, "bytes:\t%d\n", stats.Bytes)
+	fmt.Fprintf(w, "expired:\t%d\n", stats.Expired)
+	fmt.Fprintf(w, "images:\t%d\n", stats.Images)
+	fmt.Fprintf(w, "transforms:\t%d\n", stats.Transforms)
+
+	statuses := make([]int, 0, len(stats.Statuses))
+	for status := range stats.Statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "status %d:\t%d\n", status, stats.Statuses[status])
+	}
+	return w.Flush()
+}
+
+func printEntry(out io.Writer, entry assets.CacheEntry) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "remote path:\t%s\n", entry.RemotePath)
+	if entry.Transform != "" {
+		fmt.Fprintf(w, "xform:\t%s\n", entry.Transform)
+	}
+	fmt.Fprintf(w, "file:\t%s\n", entry.Path)
+	fmt.Fprintf(w, "type:\t%s\n", entry.Type)
+	fmt.Fprintf(w, "status:\t%d\n", entry.Status)
+	fmt.Fprintf(w, "expires:\t%s\n", formatExpires(entry))
+	fmt.Fprintf(w, "content type:\t%s\n", entry.ContentType)
+	fmt.Fprintf(w, "body length:\t%d\n", entry.BodyLength)
+	fmt.Fprintf(w, "size on disk:\t%d\n", entry.Size)
+	if entry.Checksum != "" {
+		fmt.Fprintf(w, "checksum:\t%s\n", entry.Checksum)
+	}
+
+	names := make([]string, 0, len(entry.Headers))
+	for name := range entry.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s:\t%s\n", name, entry.Headers[name])
+	}
+	w.Flush()
+}
+
+func formatExpires(entry assets.CacheEntry) string {
+	expires := entry.Expires.UTC().Format(time.RFC3339)
+	if entry.Expired {
+		return expires + " (expired)"
+	}
+	return expires
+}
+
+func formatRemotePath(entry assets.CacheEntry) string {
+	remotePath := entry.RemotePath
+	if remotePath == "" {
+		remotePath = "?"
+	}
+	if entry.Transform != "" {
+		return remotePath + "?xform=" + entry.Transform
+	}
+	return remotePath
+}
@@ -2,12 +2,22 @@ package main
 
 import (
 	"flag"
+	"os"
 
 	"src.goblgobl.com/assets"
 	"src.goblgobl.com/utils/log"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "cache":
+			os.Exit(cacheCommand(os.Args[2:]))
+		case "warm":
+			os.Exit(warmCommand(os.Args[2:]))
+		}
+	}
+
 	configPath := flag.String("config", "config.json", "full path to config file")
 	flag.Parse()
 
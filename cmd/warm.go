@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"src.goblgobl.com/assets"
+)
+
+const warmUsage = `usage: assets warm [flags] [file]
+
+Fetches (and optionally transforms) every path listed in file, one per line
+or a sitemap, so that they're cached. Reads from stdin when file is omitted
+or "-".
+
+The paths are sent, in batches, to the running node's POST /warm admin
+endpoint (which requires admin.key), so that the node accounts for what's
+cached (max_cache_bytes, tags). -offline warms the cache directly from this
+process instead, which must only be done while no node is running on the
+cache: a running node wouldn't know about the files.
+
+flags:
+`
+
+// assets warm
+func warmCommand(args []string) int {
+	flags := flag.NewFlagSet("warm", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), warmUsage)
+		flags.PrintDefaults()
+	}
+	configPath := flags.String("config", "config.json", "full path to config file")
+	upstreamName := flags.String("upstream", "", "upstream to warm (optional when only one is configured)")
+	xform := flags.String("xform", "", "comma separated transforms to generate for images")
+	concurrency := flags.Int("concurrency", assets.DEFAULT_WARM_CONCURRENCY, "number of paths to warm at once")
+	server := flags.String("server", "", "address of the running node (defaults to http.listen)")
+	offline := flags.Bool("offline", false, "warm the cache from this process, only when no node is running")
+	asJSON := flags.Bool("json", false, "output JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	if err := assets.Configure(*configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config (%s): %s\n", *configPath, err)
+		return 1
+	}
+
+	name, err := resolveUpstream(*upstreamName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var input io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		input = f
+	}
+
+	var xforms []string
+	if *xform != "" {
+		xforms = strings.Split(*xform, ",")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	progress := func(result assets.WarmResult) {
+		if *asJSON {
+			encoder.Encode(result)
+			return
+		}
+		line := fmt.Sprintf("%-8s %3d %s", result.Result, result.Status, result.Path)
+		if result.XForm != "" {
+			line += "?xform=" + result.XForm
+		}
+		if result.Error != "" {
+			line += " - " + result.Error
+		}
+		fmt.Println(line)
+	}
+
+	var summary assets.WarmSummary
+	if *offline {
+		summary, err = warmOffline(name, input, xforms, *concurrency, progress)
+	} else {
+		summary, err = warmNode(*server, name, input, xforms, *concurrency, progress)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *asJSON {
+		// the failures were already printed as they happened
+		summary.Failures = nil
+		encoder.Encode(summary)
+	} else {
+		fmt.Printf("\n%d total, %d cached, %d fetched, %d uncached, %d failed\n", summary.Total, summary.Cached, summary.Fetched, summary.Uncached, summary.Failed)
+	}
+
+	if summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func warmOffline(name string, input io.Reader, xforms []string, concurrency int, progress func(assets.WarmResult)) (assets.WarmSummary, error) {
+	up, err := assets.NewUpstream(name, assets.Config.Upstreams[name])
+	if err != nil {
+		return assets.WarmSummary{}, err
+	}
+
+	paths, err := up.ParseWarmList(input)
+	if err != nil {
+		return assets.WarmSummary{}, fmt.Errorf("failed to read paths: %w", err)
+	}
+	return up.Warm(paths, xforms, concurrency, progress)
+}
+
+// Sends the list to the node, MAX_WARM_PATHS at a time. The node only
+// reports each batch once it's done, so progress comes a batch at a time.
+func warmNode(server string, name string, input io.Reader, xforms []string, concurrency int, progress func(assets.WarmResult)) (assets.WarmSummary, error) {
+	summary := assets.WarmSummary{Failures: []assets.WarmResult{}}
+
+	key := assets.Config.Admin.Key
+	if key == "" {
+		return summary, errors.New("admin.key must be configured to warm a running node (or use -offline)")
+	}
+
+	entries, err := assets.ReadWarmList(input)
+	if err != nil {
+		return summary, fmt.Errorf("failed to read paths: %w", err)
+	}
+
+	if server == "" {
+		server = assets.Config.HTTP.Listen
+		if server == "" {
+			server = "127.0.0.1:5300"
+		}
+	}
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+
+	query := url.Values{"up": []string{name}, "concurrency": []string{strconv.Itoa(concurrency)}}
+	if len(xforms) > 0 {
+		query.Set("xform", strings.Join(xforms, ","))
+	}
+	warmURL := strings.TrimSuffix(server, "/") + "/warm?" + query.Encode()
+
+	for len(entries) > 0 {
+		batch := entries
+		if len(batch) > assets.MAX_WARM_PATHS {
+			batch = batch[:assets.MAX_WARM_PATHS]
+		}
+		entries = entries[len(batch):]
+
+		batchResponse, err := postWarm(warmURL, key, batch)
+		if err != nil {
+			return summary, err
+		}
+		batchSummary := batchResponse.WarmSummary
+
+		summary.Total += batchSummary.Total
+		summary.Cached += batchSummary.Cached
+		summary.Fetched += batchSummary.Fetched
+		summary.Uncached += batchSummary.Uncached
+		summary.Failed += batchSummary.Failed
+		summary.Failures = append(summary.Failures, batchSummary.Failures...)
+		for _, result := range batchResponse.Results {
+			progress(result)
+		}
+	}
+	return summary, nil
+}
+
+func postWarm(warmURL string, key string, entries []string) (assets.WarmResponse, error) {
+	var response assets.WarmResponse
+
+	req, err := http.NewRequest("POST", warmURL, strings.NewReader(strings.Join(entries, "\n")))
+	if err != nil {
+		return response, err
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Content-Type", "text/plain")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return response, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return response, err
+	}
+	if res.StatusCode != 200 {
+		return response, fmt.Errorf("node responded with %d: %s", res.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return response, fmt.Errorf("invalid response from node: %w", err)
+	}
+	return response, nil
+}
@@ -6,16 +6,31 @@ const (
 	RES_UNKNOWN_UP_PARAM    = 202_003
 	RES_INVALID_XFORM_PARAM = 202_004
 	RES_NOT_FOUND_CACHE     = 202_005
+	RES_UNAUTHORIZED        = 202_006
+	RES_INVALID_WARM_LIST   = 202_007
+	RES_TOO_MANY_WARM_PATHS = 202_008
 
-	ERR_CONFIG_READ           = 203_001
-	ERR_CONFIG_PARSE          = 203_002
-	ERR_CONFIG_ZERO_UPSTREAMS = 203_003
-	ERR_CONFIG_UPSTREAM_BASE  = 203_004
-	ERR_CONFIG_VIPS_PATH      = 203_005
-	ERR_CONFIG_VIPS_VERSION   = 203_006
-	ERR_PROXY                 = 203_007
-	ERR_TRANSFORM             = 203_008
-	ERR_LOCAL_IMAGE_MISSING   = 203_009
-	ERR_FS_STAT               = 203_010
-	ERR_UNCAUGHT_HTTP         = 203_011
+	ERR_CONFIG_READ            = 203_001
+	ERR_CONFIG_PARSE           = 203_002
+	ERR_CONFIG_ZERO_UPSTREAMS  = 203_003
+	ERR_CONFIG_UPSTREAM_BASE   = 203_004
+	ERR_CONFIG_VIPS_PATH       = 203_005
+	ERR_CONFIG_VIPS_VERSION    = 203_006
+	ERR_PROXY                  = 203_007
+	ERR_TRANSFORM              = 203_008
+	ERR_LOCAL_IMAGE_MISSING    = 203_009
+	ERR_FS_STAT                = 203_010
+	ERR_UNCAUGHT_HTTP          = 203_011
+	ERR_FS_REMOVE              = 203_012
+	ERR_TAG_INDEX              = 203_013
+	ERR_CONFIG_UPSTREAM_STORE  = 203_014
+	ERR_CONFIG_UPSTREAM_LAYOUT = 203_015
+	ERR_CACHE_MIGRATE          = 203_016
+	ERR_PROXY_TIMEOUT          = 203_017
+	ERR_CONFIG_UPSTREAM_RETRY  = 203_018
+	ERR_PROXY_CIRCUIT_OPEN     = 203_019
+	ERR_CONFIG_UPSTREAM_AUTH   = 203_020
+	ERR_UPSTREAM_AUTH          = 203_021
+	ERR_CONFIG_UPSTREAM_S3     = 203_022
+	ERR_OBJECT_TOO_LARGE       = 203_023
 )
@@ -17,6 +17,21 @@ var (
 		upstreamCacheConfig{Status: 404, TTL: -60},
 		upstreamCacheConfig{Status: 200, TTL: 3600},
 	}
+
+	// upstream response headers that we store and replay (on top of the
+	// Content-Type and Cache-Control, which we always keep)
+	DefaultHeaders = []string{
+		"ETag",
+		"Last-Modified",
+		"Content-Encoding",
+		"Content-Disposition",
+		"Vary",
+		"Access-Control-Allow-Origin",
+		"Access-Control-Allow-Methods",
+		"Access-Control-Allow-Headers",
+		"Access-Control-Expose-Headers",
+		"Access-Control-Max-Age",
+	}
 )
 
 type config struct {
@@ -26,6 +41,7 @@ type config struct {
 
 	CacheRoot string                     `json:"cache_root"`
 	HTTP      httpConfig                 `json:"http"`
+	Admin     adminConfig                `json:"admin"`
 	Log       log.Config                 `json:"log"`
 	Upstreams map[string]*upstreamConfig `json:"upstreams"`
 }
@@ -34,11 +50,157 @@ type httpConfig struct {
 	Listen string `json:"listen"`
 }
 
+type adminConfig struct {
+	// Admin routes (e.g. purging) require an "Authorization: Bearer $KEY"
+	// header. Without a key, admin routes are disabled.
+	Key string `json:"key"`
+}
+
 type upstreamConfig struct {
-	BaseURL    string                `json:"base_url"`
-	Buffers    *buffer.Config        `json:"buffers"`
-	Caching    []upstreamCacheConfig `json:"caching"`
-	Transforms map[string][]string   `json:"transforms"`
+	BaseURL       string                 `json:"base_url"`
+	Buffers       *buffer.Config         `json:"buffers"`
+	Caching       []upstreamCacheConfig  `json:"caching"`
+	Transforms    map[string][]string    `json:"transforms"`
+	Headers       []string               `json:"headers"`
+	MaxCacheBytes int64                  `json:"max_cache_bytes"`
+	Sweep         *upstreamSweepConfig   `json:"sweep"`
+	HTTP          *upstreamHTTPConfig    `json:"http"`
+	Retry         *upstreamRetryConfig   `json:"retry"`
+	Breaker       *upstreamBreakerConfig `json:"breaker"`
+	Store         string                 `json:"store"`
+
+	// Several hosts serving the same content, used instead of base_url
+	BaseURLs []upstreamHostConfig `json:"base_urls"`
+	// a host is skipped after this many consecutive failures, for
+	// host_cooldown seconds (defaults: 3 and 30)
+	HostFailures int   `json:"host_failures"`
+	HostCooldown int32 `json:"host_cooldown"`
+
+	// an S3-compatible bucket, used instead of base_url
+	S3 *upstreamS3Config `json:"s3"`
+
+	// query parameters that are forwarded to the upstream and are part of
+	// the cache key, all others are dropped
+	QueryParams []string `json:"query_params"`
+
+	// sent with every request to the upstream ("Host" overrides the host)
+	RequestHeaders map[string]string   `json:"request_headers"`
+	Auth           *upstreamAuthConfig `json:"auth"`
+
+	// "hash" (default) or "base64" (the original layout, which can't cache
+	// long remote paths)
+	CacheLayout string `json:"cache_layout"`
+
+	// responses larger than this many bytes are streamed to the store rather
+	// than buffered in memory (defaults to, and can't exceed, buffers.max)
+	StreamThreshold int64 `json:"stream_threshold"`
+
+	// responses larger than this many bytes aren't cached, they're passed
+	// straight through to the client (0 == no limit). max_object_sizes
+	// overrides it per extension (e.g. {"mp4": 0, "png": 5000000})
+	MaxObjectSize  int64            `json:"max_object_size"`
+	MaxObjectSizes map[string]int64 `json:"max_object_sizes"`
+
+	// in-memory tier in front of the store, for small popular responses
+	HotCacheBytes     int64  `json:"hot_cache_bytes"`
+	HotMaxObjectBytes uint32 `json:"hot_max_object_bytes"`
+
+	// seconds that an expired entry is still served for, while it's refreshed
+	// in the background
+	StaleWhileRevalidate int32 `json:"stale_while_revalidate"`
+
+	// seconds that an expired entry is still served for when the upstream
+	// errors or returns a 5xx
+	StaleIfError int32 `json:"stale_if_error"`
+
+	// fraction of cache hits (0-1) which verify the body's checksum, defaults to 1
+	ChecksumSample *float64 `json:"checksum_sample"`
+}
+
+type upstreamSweepConfig struct {
+	// seconds between sweeps, a negative value disables the sweeper
+	Interval int32 `json:"interval"`
+	// seconds an entry must have been expired for before it's deleted
+	Grace int32 `json:"grace"`
+}
+
+// The client used to talk to the upstream. Timeouts are in seconds; a
+// negative value disables the timeout.
+type upstreamHTTPConfig struct {
+	ConnectTimeout        int32 `json:"connect_timeout"`
+	TLSHandshakeTimeout   int32 `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout int32 `json:"response_header_timeout"`
+	// the entire request, including reading the body. Off by default, since
+	// it would abort large streamed and pass-through bodies; the other
+	// timeouts cover a stalled upstream.
+	Timeout int32 `json:"timeout"`
+
+	MaxIdleConns        int   `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int   `json:"max_idle_conns_per_host"`
+	IdleConnTimeout     int32 `json:"idle_conn_timeout"`
+	// seconds between keep-alive probes, a negative value disables keep-alive
+	KeepAlive int32 `json:"keep_alive"`
+
+	MaxResponseHeaderBytes int64 `json:"max_response_header_bytes"`
+}
+
+type upstreamRetryConfig struct {
+	// total attempts, including the first, 1 disables retries
+	Attempts int `json:"attempts"`
+	// response statuses to retry
+	Statuses []int `json:"statuses"`
+	// failures to retry: "network" (connection refused, reset, ...) and/or "timeout"
+	Errors []string `json:"errors"`
+	// the delay before the first retry, doubled (with jitter) for each retry
+	// after that, up to MaxBackoffMS
+	BackoffMS    int32 `json:"backoff_ms"`
+	MaxBackoffMS int32 `json:"max_backoff_ms"`
+	// no retry is started once this much time has passed since the first attempt
+	DeadlineMS int32 `json:"deadline_ms"`
+}
+
+// The circuit breaker is only enabled when failures and/or error_rate is set
+type upstreamBreakerConfig struct {
+	// open after this many failures within the window
+	Failures int `json:"failures"`
+	// open once this fraction (0-1) of requests within the window failed...
+	ErrorRate float64 `json:"error_rate"`
+	// ...provided we've seen at least this many requests, defaults to 20
+	MinRequests int `json:"min_requests"`
+	// seconds, defaults to 30
+	Window int32 `json:"window"`
+	// seconds to stay open before probing the upstream, defaults to 15
+	Cooldown int32 `json:"cooldown"`
+}
+
+type upstreamHostConfig struct {
+	URL string `json:"url"`
+	// relative share of requests this host gets, defaults to 1
+	Weight int `json:"weight"`
+}
+
+type upstreamAuthConfig struct {
+	// bearer, basic or bearer_file
+	Type      string `json:"type"`
+	Token     string `json:"token"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	TokenFile string `json:"token_file"`
+}
+
+type upstreamS3Config struct {
+	// defaults to AWS (https://s3.REGION.amazonaws.com)
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+	// https://ENDPOINT/BUCKET/KEY rather than https://BUCKET.ENDPOINT/KEY
+	PathStyle       bool   `json:"path_style"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+	// buckets which we can't list return a 403, rather than a 404, for
+	// missing keys
+	ForbiddenAsNotFound bool `json:"forbidden_as_not_found"`
 }
 
 type upstreamCacheConfig struct {
@@ -82,9 +244,42 @@ func Configure(filePath string) error {
 	}
 
 	for name, up := range Config.Upstreams {
-		if up.BaseURL == "" {
+		if s3 := up.S3; s3 != nil {
+			if err := s3.validate(); err != nil {
+				return log.Err(ERR_CONFIG_UPSTREAM_S3, err).String("upstream", name)
+			}
+			if up.Auth != nil {
+				return log.Err(ERR_CONFIG_UPSTREAM_S3, errors.New("upstream can't have both s3 and auth")).String("upstream", name)
+			}
+			if up.BaseURL == "" && len(up.BaseURLs) == 0 {
+				up.BaseURL = s3BaseURL(s3)
+			}
+		}
+
+		if up.BaseURL == "" && len(up.BaseURLs) == 0 {
 			return log.Err(ERR_CONFIG_UPSTREAM_BASE, errors.New("upstream must have a base_url")).String("upstream", name)
 		}
+		for _, host := range up.BaseURLs {
+			if host.URL == "" {
+				return log.Err(ERR_CONFIG_UPSTREAM_BASE, errors.New("upstream base_urls must each have a url")).String("upstream", name)
+			}
+		}
+
+		switch up.Store {
+		case "", "disk", "memory":
+		default:
+			return log.Err(ERR_CONFIG_UPSTREAM_STORE, errors.New("upstream store must be disk or memory")).String("upstream", name)
+		}
+
+		switch up.CacheLayout {
+		case "", "hash", "base64":
+		default:
+			return log.Err(ERR_CONFIG_UPSTREAM_LAYOUT, errors.New("upstream cache_layout must be hash or base64")).String("upstream", name)
+		}
+
+		if err := up.Auth.validate(); err != nil {
+			return log.Err(ERR_CONFIG_UPSTREAM_AUTH, err).String("upstream", name)
+		}
 
 		if up.Buffers == nil {
 			// we don't need particulalry large buffers, as all we're using
@@ -108,7 +303,129 @@ func Configure(filePath string) error {
 		if len(up.Caching) == 0 {
 			up.Caching = DefaultCaching
 		}
+
+		if up.HotMaxObjectBytes == 0 {
+			up.HotMaxObjectBytes = 65536 // 64KB
+		}
+
+		if up.Headers == nil {
+			up.Headers = DefaultHeaders
+		}
+
+		if up.Sweep == nil {
+			up.Sweep = &upstreamSweepConfig{}
+		}
+
+		if up.Sweep.Interval == 0 {
+			up.Sweep.Interval = 3600
+		}
+
+		if up.HTTP == nil {
+			up.HTTP = &upstreamHTTPConfig{}
+		}
+		up.HTTP.defaults()
+
+		if up.Retry == nil {
+			up.Retry = &upstreamRetryConfig{}
+		}
+		if err := up.Retry.defaults(); err != nil {
+			return log.Err(ERR_CONFIG_UPSTREAM_RETRY, err).String("upstream", name)
+		}
+	}
+
+	return nil
+}
+
+func (c *upstreamHTTPConfig) defaults() {
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = 5
+	}
+	if c.TLSHandshakeTimeout == 0 {
+		c.TLSHandshakeTimeout = 5
+	}
+	if c.ResponseHeaderTimeout == 0 {
+		c.ResponseHeaderTimeout = 15
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = 100
 	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = 16
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = 90
+	}
+	if c.KeepAlive == 0 {
+		c.KeepAlive = 30
+	}
+	if c.MaxResponseHeaderBytes == 0 {
+		c.MaxResponseHeaderBytes = 65536 // 64KB
+	}
+}
 
+func (c *upstreamRetryConfig) defaults() error {
+	for _, e := range c.Errors {
+		if e != RETRY_NETWORK && e != RETRY_TIMEOUT {
+			return errors.New("upstream retry errors must be network or timeout")
+		}
+	}
+
+	if c.Attempts == 0 {
+		c.Attempts = 3
+	}
+	if c.Statuses == nil {
+		c.Statuses = []int{502, 503, 504}
+	}
+	if c.Errors == nil {
+		c.Errors = []string{RETRY_NETWORK, RETRY_TIMEOUT}
+	}
+	if c.BackoffMS == 0 {
+		c.BackoffMS = 100
+	}
+	if c.MaxBackoffMS == 0 {
+		c.MaxBackoffMS = 2000
+	}
+	if c.DeadlineMS == 0 {
+		c.DeadlineMS = 10_000
+	}
+	return nil
+}
+
+// Errors must not include the secrets themselves
+func (c *upstreamAuthConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	switch c.Type {
+	case AUTH_BEARER:
+		if c.Token == "" {
+			return errors.New("upstream bearer auth requires a token")
+		}
+	case AUTH_BASIC:
+		if c.Username == "" {
+			return errors.New("upstream basic auth requires a username")
+		}
+	case AUTH_BEARER_FILE:
+		if c.TokenFile == "" {
+			return errors.New("upstream bearer_file auth requires a token_file")
+		}
+	default:
+		return errors.New("upstream auth type must be bearer, basic or bearer_file")
+	}
+	return nil
+}
+
+// Errors must not include the secrets themselves
+func (c *upstreamS3Config) validate() error {
+	if c.Bucket == "" {
+		return errors.New("upstream s3 requires a bucket")
+	}
+	if c.Region == "" {
+		return errors.New("upstream s3 requires a region")
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return errors.New("upstream s3 requires an access_key_id and secret_access_key")
+	}
 	return nil
 }
@@ -36,6 +36,36 @@ func Test_Config_Upstream_Base(t *testing.T) {
 	assert.Equal(t, err.Error(), "code: 203004 - upstream must have a base_url")
 }
 
+func Test_Config_Upstream_Store(t *testing.T) {
+	defer func() { Config = testConfig }()
+	err := Configure(testConfigPath("upstream_store.json"))
+	assert.Equal(t, err.Error(), "code: 203014 - upstream store must be disk or memory")
+}
+
+func Test_Config_Upstream_CacheLayout(t *testing.T) {
+	defer func() { Config = testConfig }()
+	err := Configure(testConfigPath("upstream_layout.json"))
+	assert.Equal(t, err.Error(), "code: 203015 - upstream cache_layout must be hash or base64")
+}
+
+func Test_Config_Upstream_Retry(t *testing.T) {
+	defer func() { Config = testConfig }()
+	err := Configure(testConfigPath("upstream_retry.json"))
+	assert.Equal(t, err.Error(), "code: 203018 - upstream retry errors must be network or timeout")
+}
+
+func Test_Config_Upstream_Auth(t *testing.T) {
+	defer func() { Config = testConfig }()
+	err := Configure(testConfigPath("upstream_auth.json"))
+	assert.Equal(t, err.Error(), "code: 203020 - upstream bearer auth requires a token")
+}
+
+func Test_Config_Upstream_S3(t *testing.T) {
+	defer func() { Config = testConfig }()
+	err := Configure(testConfigPath("upstream_s3.json"))
+	assert.Equal(t, err.Error(), "code: 203022 - upstream s3 requires a bucket")
+}
+
 func Test_Config_Minimal(t *testing.T) {
 	defer func() { Config = testConfig }()
 	err := Configure(testConfigPath("minimal.json"))
@@ -58,6 +88,27 @@ func Test_Config_Minimal(t *testing.T) {
 	assert.Equal(t, up1.Caching[1].TTL, -60)
 	assert.Equal(t, up1.Caching[2].Status, 200)
 	assert.Equal(t, up1.Caching[2].TTL, 3600)
+
+	assert.Equal(t, len(up1.Headers), len(DefaultHeaders))
+	assert.Equal(t, up1.Sweep.Interval, 3600)
+	assert.Equal(t, up1.Sweep.Grace, 0)
+
+	assert.Equal(t, up1.HTTP.ConnectTimeout, 5)
+	assert.Equal(t, up1.HTTP.TLSHandshakeTimeout, 5)
+	assert.Equal(t, up1.HTTP.ResponseHeaderTimeout, 15)
+	assert.Equal(t, up1.HTTP.Timeout, 0)
+	assert.Equal(t, up1.HTTP.MaxIdleConns, 100)
+	assert.Equal(t, up1.HTTP.MaxIdleConnsPerHost, 16)
+	assert.Equal(t, up1.HTTP.IdleConnTimeout, 90)
+	assert.Equal(t, up1.HTTP.KeepAlive, 30)
+	assert.Equal(t, up1.HTTP.MaxResponseHeaderBytes, 65536)
+
+	assert.Equal(t, up1.Retry.Attempts, 3)
+	assert.Equal(t, len(up1.Retry.Statuses), 3)
+	assert.Equal(t, len(up1.Retry.Errors), 2)
+	assert.Equal(t, up1.Retry.BackoffMS, 100)
+	assert.Equal(t, up1.Retry.MaxBackoffMS, 2000)
+	assert.Equal(t, up1.Retry.DeadlineMS, 10_000)
 }
 
 func testConfigPath(file string) string {
@@ -0,0 +1,155 @@
+package assets
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	gohttp "net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lets an upstream's base_url be a directory (file:///srv/assets/). Requests
+// for file:// URLs are served from the filesystem as though they came from an
+// HTTP origin, so they go through the same caching and transform pipeline.
+// Only files within one of the upstream's directories can be served, even
+// through symlinks.
+type fileTransport struct {
+	roots []fileRoot
+}
+
+type fileRoot struct {
+	// cleaned, as configured
+	path string
+	// with symlinks resolved
+	resolved string
+}
+
+// Returns nil if none of the base URLs are file:// URLs
+func newFileTransport(baseURLs []string) (*fileTransport, error) {
+	var roots []fileRoot
+	for _, baseURL := range baseURLs {
+		if !strings.HasPrefix(baseURL, "file://") {
+			continue
+		}
+		parsed, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.Host != "" && parsed.Host != "localhost" {
+			return nil, fmt.Errorf("file base_url must be local (%s)", baseURL)
+		}
+		if !filepath.IsAbs(parsed.Path) {
+			return nil, fmt.Errorf("file base_url must be an absolute path (%s)", baseURL)
+		}
+		root := filepath.Clean(parsed.Path)
+		resolved, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, fileRoot{path: root, resolved: resolved})
+	}
+
+	if roots == nil {
+		return nil, nil
+	}
+	return &fileTransport{roots: roots}, nil
+}
+
+func (t *fileTransport) RoundTrip(req *gohttp.Request) (*gohttp.Response, error) {
+	fullPath, ok := t.resolve(req.URL.Path)
+	if !ok {
+		return fileResponse(req, 404, nil), nil
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fileResponse(req, 404, nil), nil
+		}
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		f.Close()
+		return fileResponse(req, 404, nil), nil
+	}
+
+	modTime := stat.ModTime().UTC().Truncate(time.Second)
+	header := gohttp.Header{
+		"Last-Modified": []string{modTime.Format(gohttp.TimeFormat)},
+	}
+
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		if since, err := gohttp.ParseTime(ims); err == nil && !modTime.After(since) {
+			f.Close()
+			return fileResponse(req, 304, header), nil
+		}
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(fullPath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+
+	res := fileResponse(req, 200, header)
+	res.Body = f
+	res.ContentLength = stat.Size()
+	return res, nil
+}
+
+// The file for the request's path, provided it's within one of our roots
+func (t *fileTransport) resolve(requestPath string) (string, bool) {
+	fullPath := filepath.Clean(requestPath)
+	for _, root := range t.roots {
+		if !isWithin(fullPath, root.path) {
+			continue
+		}
+
+		// the path itself is contained, but a symlink could still point outside
+		resolved, err := filepath.EvalSymlinks(fullPath)
+		if err != nil {
+			// most likely, the file doesn't exist
+			return "", false
+		}
+		if !isWithin(resolved, root.resolved) {
+			return "", false
+		}
+		return resolved, true
+	}
+	return "", false
+}
+
+func isWithin(p string, dir string) bool {
+	if dir == string(filepath.Separator) {
+		return true
+	}
+	return strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+func fileResponse(req *gohttp.Request, status int, header gohttp.Header) *gohttp.Response {
+	if header == nil {
+		header = make(gohttp.Header)
+	}
+	return &gohttp.Response{
+		Status:     strconv.Itoa(status) + " " + gohttp.StatusText(status),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+}
@@ -0,0 +1,130 @@
+package assets
+
+import (
+	gohttp "net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/tests/request"
+	"src.goblgobl.com/utils/buffer"
+	"src.goblgobl.com/utils/log"
+)
+
+func Test_FileTransport_None(t *testing.T) {
+	files, err := newFileTransport([]string{"https://www.goblgobl.com/"})
+	assert.Nil(t, err)
+	assert.Nil(t, files)
+
+	_, err = newFileTransport([]string{"file://remote/srv/"})
+	assert.NotNil(t, err)
+}
+
+func Test_FileTransport_Serve(t *testing.T) {
+	root := testFileRoot(t)
+	client := newHTTPClient(nil, testFileTransport(t, root))
+
+	res, err := client.Get("file://" + root + "/css/main.css")
+	assert.Nil(t, err)
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, res.ContentLength, 4)
+	assert.Equal(t, res.Header.Get("Content-Type"), "text/css; charset=utf-8")
+	lastModified := res.Header.Get("Last-Modified")
+	assert.Equal(t, lastModified, "Sat, 01 Jan 2022 10:00:00 GMT")
+	res.Body.Close()
+
+	req, _ := gohttp.NewRequest("GET", "file://"+root+"/css/main.css", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	res, err = client.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, res.StatusCode, 304)
+	res.Body.Close()
+}
+
+func Test_FileTransport_Containment(t *testing.T) {
+	root := testFileRoot(t)
+	client := newHTTPClient(nil, testFileTransport(t, root))
+
+	for _, p := range []string{
+		"/css",                  // directory
+		"/missing.css",          // doesn't exist
+		"/../secret.txt",        // outside
+		"/%2e%2e/secret.txt",    // outside, encoded
+		"/css/../../secret.txt", // outside
+		"/escape.txt",           // symlink outside
+	} {
+		res, err := client.Get("file://" + root + p)
+		assert.Nil(t, err)
+		assert.Equal(t, res.StatusCode, 404)
+		res.Body.Close()
+	}
+
+	// a symlink within the root is fine
+	res, err := client.Get("file://" + root + "/link.css")
+	assert.Nil(t, err)
+	assert.Equal(t, res.StatusCode, 200)
+	res.Body.Close()
+}
+
+func Test_Upstream_File(t *testing.T) {
+	root := testFileRoot(t)
+	up, err := NewUpstream("up_file", &upstreamConfig{
+		Store:   "memory",
+		BaseURL: "file://" + root + "/",
+		Buffers: &buffer.Config{Count: 2, Min: 4096, Max: 4096},
+	})
+	assert.Nil(t, err)
+	env := NewEnv(up)
+
+	metaPath, imagePath := up.LocalImagePath("images/tea.png", ".png", nil)
+	res, expires, err := up.SaveOriginImage("images/tea.png", metaPath, imagePath, env)
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+	assert.True(t, expires > 0)
+
+	meta, err := up.readMeta(metaPath)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.tpe, TYPE_IMAGE)
+	assert.Equal(t, meta.lastModified, "Sat, 01 Jan 2022 10:00:00 GMT")
+
+	localPath := up.LocalResPath("nope.css", ".css")
+	res, err = up.GetResponseAndSave("nope.css", localPath, env)
+	assert.Nil(t, err)
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	request.Res(t, conn).ExpectNotFound()
+}
+
+// root/
+//
+//	css/main.css
+//	images/tea.png
+//	link.css -> css/main.css
+//	escape.txt -> ../secret.txt
+func testFileRoot(t *testing.T) string {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	modTime := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	write := func(p string, data string) {
+		p = filepath.Join(dir, p)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0700))
+		assert.Nil(t, os.WriteFile(p, []byte(data), 0600))
+		assert.Nil(t, os.Chtimes(p, modTime, modTime))
+	}
+	write("secret.txt", "secret")
+	write("root/css/main.css", "body")
+	write("root/images/tea.png", "not really a png")
+	assert.Nil(t, os.Symlink(filepath.Join(root, "css/main.css"), filepath.Join(root, "link.css")))
+	assert.Nil(t, os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "escape.txt")))
+	return root
+}
+
+func testFileTransport(t *testing.T, root string) *fileTransport {
+	files, err := newFileTransport([]string{"file://" + root + "/"})
+	assert.Nil(t, err)
+	return files
+}
@@ -0,0 +1,127 @@
+package assets
+
+import (
+	"sync"
+	"time"
+)
+
+// The base URLs of an upstream. Requests are spread across healthy hosts using
+// a smooth weighted round-robin (with equal weights, that's a plain
+// round-robin). Health is tracked passively: a host that fails too many
+// requests in a row is skipped for a cooldown, after which it gets another
+// chance.
+type Hosts struct {
+	sync.Mutex
+	hosts    []*host
+	failures int
+	cooldown time.Duration
+}
+
+type host struct {
+	url    string
+	weight int
+
+	// for the smooth weighted round-robin
+	current int
+
+	// consecutive failures
+	failures  int
+	downUntil time.Time
+}
+
+func NewHosts(configs []upstreamHostConfig, failures int, cooldown int32) *Hosts {
+	if failures <= 0 {
+		failures = 3
+	}
+	if cooldown <= 0 {
+		cooldown = 30
+	}
+
+	hosts := make([]*host, len(configs))
+	for i, config := range configs {
+		weight := config.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		hosts[i] = &host{url: config.URL, weight: weight}
+	}
+
+	return &Hosts{
+		hosts:    hosts,
+		failures: failures,
+		cooldown: time.Duration(cooldown) * time.Second,
+	}
+}
+
+func (h *Hosts) URLs() []string {
+	urls := make([]string, len(h.hosts))
+	for i, host := range h.hosts {
+		urls[i] = host.url
+	}
+	return urls
+}
+
+// The hosts to try for a request, in order. The first is picked by our
+// weighted round-robin, followed by the other healthy hosts and, as a last
+// resort, the ones that are down.
+func (h *Hosts) Order() []*host {
+	hosts := h.hosts
+	if len(hosts) == 1 {
+		return hosts
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	now := time.Now()
+	total := 0
+	var picked *host
+	for _, host := range hosts {
+		if host.downUntil.After(now) {
+			continue
+		}
+		host.current += host.weight
+		total += host.weight
+		if picked == nil || host.current > picked.current {
+			picked = host
+		}
+	}
+
+	ordered := make([]*host, 0, len(hosts))
+	if picked != nil {
+		picked.current -= total
+		ordered = append(ordered, picked)
+	}
+	for _, host := range hosts {
+		if host != picked && !host.downUntil.After(now) {
+			ordered = append(ordered, host)
+		}
+	}
+	for _, host := range hosts {
+		if host.downUntil.After(now) {
+			ordered = append(ordered, host)
+		}
+	}
+	return ordered
+}
+
+func (h *Hosts) Record(host *host, failed bool) {
+	if len(h.hosts) == 1 {
+		// nowhere else to go
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if !failed {
+		host.failures = 0
+		host.downUntil = time.Time{}
+		return
+	}
+
+	host.failures += 1
+	if host.failures >= h.failures {
+		host.downUntil = time.Now().Add(h.cooldown)
+	}
+}
@@ -0,0 +1,63 @@
+package assets
+
+import (
+	"testing"
+	"time"
+
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_Hosts_Single(t *testing.T) {
+	h := NewHosts([]upstreamHostConfig{{URL: "http://a/"}}, 1, 10)
+	h.Record(h.hosts[0], true)
+	order := h.Order()
+	assert.Equal(t, len(order), 1)
+	assert.Equal(t, order[0].url, "http://a/")
+}
+
+func Test_Hosts_RoundRobin(t *testing.T) {
+	h := NewHosts([]upstreamHostConfig{{URL: "http://a/"}, {URL: "http://b/"}}, 0, 0)
+	first := h.Order()
+	second := h.Order()
+	assert.Equal(t, len(first), 2)
+	assert.Equal(t, first[0].url, "http://a/")
+	assert.Equal(t, first[1].url, "http://b/")
+	assert.Equal(t, second[0].url, "http://b/")
+	assert.Equal(t, second[1].url, "http://a/")
+	assert.Equal(t, h.Order()[0].url, "http://a/")
+}
+
+func Test_Hosts_Weighted(t *testing.T) {
+	h := NewHosts([]upstreamHostConfig{{URL: "http://a/", Weight: 3}, {URL: "http://b/"}}, 0, 0)
+	counts := map[string]int{}
+	for i := 0; i < 40; i++ {
+		counts[h.Order()[0].url] += 1
+	}
+	assert.Equal(t, counts["http://a/"], 30)
+	assert.Equal(t, counts["http://b/"], 10)
+}
+
+func Test_Hosts_Health(t *testing.T) {
+	h := NewHosts([]upstreamHostConfig{{URL: "http://a/"}, {URL: "http://b/"}}, 2, 60)
+	a := h.hosts[0]
+
+	h.Record(a, true)
+	h.Record(a, false)
+	h.Record(a, true)
+	// not consecutive
+	assert.True(t, a.downUntil.IsZero())
+
+	h.Record(a, true)
+	assert.False(t, a.downUntil.IsZero())
+	for i := 0; i < 4; i++ {
+		order := h.Order()
+		// still tried, but last
+		assert.Equal(t, order[0].url, "http://b/")
+		assert.Equal(t, order[1].url, "http://a/")
+	}
+
+	// cooldown over
+	a.downUntil = time.Now().Add(-time.Second)
+	first, second := h.Order()[0].url, h.Order()[0].url
+	assert.True(t, first == "http://a/" || second == "http://a/")
+}
@@ -0,0 +1,142 @@
+package assets
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// A bounded, in-memory tier in front of our store, holding the parsed meta
+// and body of small, frequently requested responses. An entry is only admitted
+// on its second request from the store, so that one-off requests don't push
+// out popular entries. A nil *HotCache is valid and does nothing (the upstream
+// has no hot_cache_bytes).
+type HotCache struct {
+	sync.Mutex
+	max       int64
+	maxObject uint32
+	size      int64
+	list      *list.List
+	entries   map[string]*list.Element
+
+	// paths that have been requested once (from the store)
+	seen map[string]struct{}
+}
+
+type hotEntry struct {
+	path string
+	meta *Meta
+	body []byte
+}
+
+// we don't want our doorkeeper to grow forever
+const MAX_HOT_SEEN = 10_000
+
+func NewHotCache(max int64, maxObject uint32) *HotCache {
+	if max <= 0 {
+		return nil
+	}
+	return &HotCache{
+		max:       max,
+		maxObject: maxObject,
+		list:      list.New(),
+		entries:   make(map[string]*list.Element),
+		seen:      make(map[string]struct{}),
+	}
+}
+
+// Returns the meta and body for the path, or nil if we don't have it (or
+// have it, but it's expired).
+func (c *HotCache) Get(path string) (*Meta, []byte) {
+	if c == nil {
+		return nil, nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	element, exists := c.entries[path]
+	if !exists {
+		return nil, nil
+	}
+
+	entry := element.Value.(*hotEntry)
+	if int64(entry.meta.expires) < time.Now().Unix() {
+		c.remove(element)
+		return nil, nil
+	}
+
+	c.list.MoveToFront(element)
+	return entry.meta, entry.body
+}
+
+// Whether a response, which was just loaded from the store, should be added
+func (c *HotCache) Admit(path string, meta *Meta) bool {
+	if c == nil || meta.bodyLength > c.maxObject || int64(meta.bodyLength) > c.max {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, seen := c.seen[path]; seen {
+		delete(c.seen, path)
+		return true
+	}
+
+	if len(c.seen) >= MAX_HOT_SEEN {
+		c.seen = make(map[string]struct{})
+	}
+	c.seen[path] = struct{}{}
+	return false
+}
+
+func (c *HotCache) Set(path string, meta *Meta, body []byte) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if element, exists := c.entries[path]; exists {
+		c.remove(element)
+	}
+
+	c.entries[path] = c.list.PushFront(&hotEntry{path: path, meta: meta, body: body})
+	c.size += int64(len(body))
+
+	for c.size > c.max {
+		c.remove(c.list.Back())
+	}
+}
+
+func (c *HotCache) Delete(path string) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	if element, exists := c.entries[path]; exists {
+		c.remove(element)
+	}
+	delete(c.seen, path)
+	c.Unlock()
+}
+
+func (c *HotCache) Size() int64 {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.size
+}
+
+// must be called under lock
+func (c *HotCache) remove(element *list.Element) {
+	entry := element.Value.(*hotEntry)
+	c.list.Remove(element)
+	delete(c.entries, entry.path)
+	c.size -= int64(len(entry.body))
+}
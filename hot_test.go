@@ -0,0 +1,76 @@
+package assets
+
+import (
+	"testing"
+	"time"
+
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_HotCache_Disabled(t *testing.T) {
+	c := NewHotCache(0, 100)
+	assert.Nil(t, c)
+
+	// nil cache is a noop
+	m := &Meta{bodyLength: 1}
+	assert.False(t, c.Admit("a", m))
+	c.Set("a", m, []byte("a"))
+	meta, _ := c.Get("a")
+	assert.Nil(t, meta)
+	c.Delete("a")
+}
+
+func Test_HotCache_AdmitsOnSecondRequest(t *testing.T) {
+	c := NewHotCache(100, 10)
+	small := &Meta{bodyLength: 10}
+	large := &Meta{bodyLength: 11}
+
+	assert.False(t, c.Admit("a", small))
+	assert.True(t, c.Admit("a", small))
+
+	assert.False(t, c.Admit("b", large))
+	assert.False(t, c.Admit("b", large))
+}
+
+func Test_HotCache_GetAndSet(t *testing.T) {
+	c := NewHotCache(100, 100)
+	meta, body := c.Get("a")
+	assert.Nil(t, meta)
+
+	m := &Meta{expires: uint32(time.Now().Unix() + 10)}
+	c.Set("a", m, []byte("hello"))
+	meta, body = c.Get("a")
+	assert.True(t, meta == m)
+	assert.Equal(t, string(body), "hello")
+	assert.Equal(t, c.Size(), 5)
+
+	c.Delete("a")
+	meta, _ = c.Get("a")
+	assert.Nil(t, meta)
+	assert.Equal(t, c.Size(), 0)
+
+	// expired
+	c.Set("b", &Meta{expires: uint32(time.Now().Unix() - 1)}, []byte("hello"))
+	meta, _ = c.Get("b")
+	assert.Nil(t, meta)
+	assert.Equal(t, c.Size(), 0)
+}
+
+func Test_HotCache_LimitsSize(t *testing.T) {
+	c := NewHotCache(10, 10)
+	m := &Meta{expires: uint32(time.Now().Unix() + 10)}
+	c.Set("a", m, []byte("1234"))
+	c.Set("b", m, []byte("1234"))
+
+	// a is now more recently used than b
+	c.Get("a")
+	c.Set("c", m, []byte("1234"))
+	assert.Equal(t, c.Size(), 8)
+
+	meta, _ := c.Get("b")
+	assert.Nil(t, meta)
+	meta, _ = c.Get("a")
+	assert.NotNil(t, meta)
+	meta, _ = c.Get("c")
+	assert.NotNil(t, meta)
+}
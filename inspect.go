@@ -0,0 +1,215 @@
+package assets
+
+import (
+	"encoding/base64"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"src.goblgobl.com/utils/buffer"
+)
+
+// What we know about a cached entry, without loading its body. Used by the
+// `assets cache` commands.
+type CacheEntry struct {
+	Path        string            `json:"path"`
+	RemotePath  string            `json:"remote_path"`
+	Transform   string            `json:"xform,omitempty"`
+	Type        string            `json:"type"`
+	Status      int               `json:"status"`
+	Expires     time.Time         `json:"expires"`
+	Expired     bool              `json:"expired"`
+	ContentType string            `json:"content_type"`
+	BodyLength  uint32            `json:"body_length"`
+	Size        int64             `json:"size"`
+	Checksum    string            `json:"checksum,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// Read-only access to an upstream's cache, for the `assets cache` commands.
+// Unlike NewUpstream, this doesn't load the cache's size accounting (which
+// evicts), open the tag index or clean up temporary files, so it's safe to
+// use on the cache of a running server.
+type CacheReader struct {
+	// only has what's needed to find and parse cache files
+	upstream *Upstream
+}
+
+func NewCacheReader(name string, config *upstreamConfig) *CacheReader {
+	return &CacheReader{upstream: &Upstream{
+		name:        name,
+		cacheRoot:   []byte(upstreamCacheRoot(name)),
+		store:       readOnlyDiskStore{},
+		legacyNames: config.CacheLayout == "base64",
+		transforms:  config.Transforms,
+		buffers:     buffer.NewPoolFromConfig(*config.Buffers),
+	}}
+}
+
+func (r *CacheReader) ListCache(fn func(entry CacheEntry) error) error {
+	return r.upstream.ListCache(fn)
+}
+
+func (r *CacheReader) CacheStats() (CacheStats, error) {
+	return r.upstream.CacheStats()
+}
+
+func (r *CacheReader) CachePaths(remotePath string) []string {
+	return r.upstream.CachePaths(remotePath)
+}
+
+func (r *CacheReader) InspectCache(metaPath string) (CacheEntry, error) {
+	return r.upstream.InspectCache(metaPath)
+}
+
+type CacheStats struct {
+	Entries    int         `json:"entries"`
+	Bytes      int64       `json:"bytes"`
+	Expired    int         `json:"expired"`
+	Images     int         `json:"images"`
+	Transforms int         `json:"transforms"`
+	Statuses   map[int]int `json:"statuses"`
+}
+
+// Calls fn for every entry in the upstream's cache, in no particular order.
+// Files which can't be parsed are skipped.
+func (u *Upstream) ListCache(fn func(entry CacheEntry) error) error {
+	return u.store.List(string(u.cacheRoot), func(metaPath string, info StoreInfo) error {
+		if !strings.HasSuffix(metaPath, ".res") {
+			return nil
+		}
+		entry, err := u.InspectCache(metaPath)
+		if err != nil {
+			// could have been removed since we listed the directory, or it's
+			// not one of ours
+			return nil
+		}
+		return fn(entry)
+	})
+}
+
+func (u *Upstream) CacheStats() (CacheStats, error) {
+	stats := CacheStats{Statuses: make(map[int]int)}
+	err := u.ListCache(func(entry CacheEntry) error {
+		stats.Entries += 1
+		stats.Bytes += entry.Size
+		stats.Statuses[entry.Status] += 1
+		if entry.Expired {
+			stats.Expired += 1
+		}
+		if entry.Type == "image" {
+			stats.Images += 1
+			if entry.Transform != "" {
+				stats.Transforms += 1
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// The meta path(s) that a remote path is cached under. For images, this
+// includes the origin and every configured transform. Only some of these
+// might actually exist.
+func (u *Upstream) CachePaths(remotePath string) []string {
+	extension := remoteExtension(remotePath)
+	if !isImageExtension(extension) {
+		return []string{u.LocalResPath(remotePath, extension)}
+	}
+
+	metaPath, _ := u.LocalImagePath(remotePath, extension, nil)
+	paths := []string{metaPath}
+
+	xforms := make([]string, 0, len(u.transforms))
+	for xform := range u.transforms {
+		xforms = append(xforms, xform)
+	}
+	sort.Strings(xforms)
+
+	for _, xform := range xforms {
+		metaPath, _ := u.LocalImagePath(remotePath, extension, []byte(xform))
+		paths = append(paths, metaPath)
+	}
+	return paths
+}
+
+// Describes a single cache entry, given the path to its meta file
+func (u *Upstream) InspectCache(metaPath string) (CacheEntry, error) {
+	f, err := u.store.Open(metaPath)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	defer f.Close()
+
+	meta, err := MetaFromReader(u, f, true)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+
+	info, err := u.store.Stat(metaPath)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+
+	entry := CacheEntry{
+		Path:        metaPath,
+		Type:        "generic",
+		Status:      int(meta.status),
+		Expires:     time.Unix(int64(meta.expires), 0),
+		Expired:     int64(meta.expires) < time.Now().Unix(),
+		ContentType: meta.contentType,
+		BodyLength:  meta.bodyLength,
+		Size:        info.Size,
+	}
+	entry.RemotePath, entry.Transform = u.describeCacheFile(metaPath, meta)
+
+	if meta.tpe == TYPE_IMAGE {
+		entry.Type = "image"
+		if info, err := u.store.Stat(metaPath[:len(metaPath)-4]); err == nil {
+			entry.Size += info.Size
+		} else if !os.IsNotExist(err) {
+			return CacheEntry{}, err
+		}
+	}
+
+	if meta.hasChecksum {
+		var checksum [4]byte
+		BIN_ENCODER.PutUint32(checksum[:], meta.checksum)
+		entry.Checksum = base64.RawURLEncoding.EncodeToString(checksum[:])
+	}
+
+	headers := make(map[string]string, len(meta.headers)+2)
+	if meta.cacheControl != "" {
+		headers["Cache-Control"] = meta.cacheControl
+	}
+	for _, header := range meta.headers {
+		headers[header.name] = header.value
+	}
+	if len(headers) > 0 {
+		entry.Headers = headers
+	}
+
+	return entry, nil
+}
+
+// The remote path and transform (if any) of a cache file. Newer files store
+// the remote path in the meta, older ones (using the base64 layout) have it
+// encoded in the filename.
+func (u *Upstream) describeCacheFile(metaPath string, meta *Meta) (string, string) {
+	if remotePath, xform, _, ok := u.parseLegacyName(metaPath, meta.remotePath); ok {
+		return remotePath, xform
+	}
+
+	// hash layout: hash + ["_" + xform] + extension + ".res"
+	name := path.Base(metaPath)
+	if i := strings.IndexByte(name, '.'); i != -1 {
+		name = name[:i]
+	}
+	keyLength := base64.RawURLEncoding.EncodedLen(CACHE_KEY_LENGTH)
+	if len(name) > keyLength+1 && name[keyLength] == '_' {
+		return meta.remotePath, name[keyLength+1:]
+	}
+	return meta.remotePath, ""
+}
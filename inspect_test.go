@@ -0,0 +1,172 @@
+package assets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/utils/buffer"
+)
+
+func Test_Upstream_InspectCache(t *testing.T) {
+	up := testInspectUpstream("up_inspect1")
+	env := NewEnv(up)
+
+	localPath := writeLocal(env, "inspect/main.css", BuildRemoteResponse().
+		Body("body").
+		ContentType("text/css").
+		CacheControl("public").
+		Header("ETag", `"e1"`).
+		RemotePath("inspect/main.css").
+		Checksum().
+		Response())
+
+	entry, err := up.InspectCache(localPath)
+	assert.Nil(t, err)
+	assert.Equal(t, entry.Path, localPath)
+	assert.Equal(t, entry.RemotePath, "inspect/main.css")
+	assert.Equal(t, entry.Transform, "")
+	assert.Equal(t, entry.Type, "generic")
+	assert.Equal(t, entry.Status, 200)
+	assert.False(t, entry.Expired)
+	assert.Equal(t, entry.ContentType, "text/css")
+	assert.Equal(t, entry.BodyLength, 4)
+	assert.True(t, entry.Size > 4)
+	assert.True(t, entry.Checksum != "")
+	assert.Equal(t, entry.Headers["ETag"], `"e1"`)
+	assert.Equal(t, entry.Headers["Cache-Control"], "public")
+}
+
+func Test_Upstream_InspectCache_Image(t *testing.T) {
+	up := testInspectUpstream("up_inspect2")
+	env := NewEnv(up)
+
+	metaPath, imagePath := up.LocalImagePath("inspect/tea.png", ".png", []byte("thumb_100"))
+	w, _ := up.store.Create(imagePath)
+	w.Write([]byte("image"))
+	assert.Nil(t, w.Commit())
+	meta := &Meta{tpe: TYPE_IMAGE, status: 200, bodyLength: 5, remotePath: "inspect/tea.png"}
+	assert.Nil(t, up.save(meta, metaPath, env))
+
+	entry, err := up.InspectCache(metaPath)
+	assert.Nil(t, err)
+	assert.Equal(t, entry.RemotePath, "inspect/tea.png")
+	assert.Equal(t, entry.Transform, "thumb_100")
+	assert.Equal(t, entry.Type, "image")
+	assert.True(t, entry.Expired)
+	assert.True(t, entry.Size > 5) // meta + image
+}
+
+func Test_Upstream_InspectCache_Legacy(t *testing.T) {
+	up := testInspectUpstream("up_inspect3")
+	env := NewEnv(up)
+
+	legacy := *up
+	legacy.legacyNames = true
+	metaPath, _ := legacy.LocalImagePath("inspect/tea.png", ".png", []byte("thumb_100"))
+	assert.Nil(t, up.save(&Meta{tpe: TYPE_IMAGE, status: 404}, metaPath, env))
+
+	entry, err := up.InspectCache(metaPath)
+	assert.Nil(t, err)
+	assert.Equal(t, entry.RemotePath, "inspect/tea.png")
+	assert.Equal(t, entry.Transform, "thumb_100")
+	assert.Equal(t, entry.Status, 404)
+}
+
+func Test_Upstream_CacheStats(t *testing.T) {
+	up := testInspectUpstream("up_inspect4")
+	env := NewEnv(up)
+
+	writeLocal(env, "a.css", BuildRemoteResponse().Body("a").Response())
+	writeLocal(env, "b.css", BuildRemoteResponse().Body("b").Status(404).Response())
+	metaPath, _ := up.LocalImagePath("c.png", ".png", []byte("thumb_100"))
+	assert.Nil(t, up.save(&Meta{tpe: TYPE_IMAGE, status: 200}, metaPath, env))
+
+	seen := 0
+	assert.Nil(t, up.ListCache(func(entry CacheEntry) error {
+		seen += 1
+		return nil
+	}))
+	assert.Equal(t, seen, 3)
+
+	stats, err := up.CacheStats()
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Entries, 3)
+	assert.Equal(t, stats.Expired, 1)
+	assert.Equal(t, stats.Images, 1)
+	assert.Equal(t, stats.Transforms, 1)
+	assert.Equal(t, stats.Statuses[200], 2)
+	assert.Equal(t, stats.Statuses[404], 1)
+	assert.True(t, stats.Bytes > 0)
+}
+
+func Test_Upstream_CachePaths(t *testing.T) {
+	up := testInspectUpstream("up_inspect5")
+
+	paths := up.CachePaths("x/main.css")
+	assert.Equal(t, len(paths), 1)
+	assert.Equal(t, paths[0], up.LocalResPath("x/main.css", ".css"))
+
+	origin, _ := up.LocalImagePath("x/Tea.PNG", ".png", nil)
+	thumb, _ := up.LocalImagePath("x/Tea.PNG", ".png", []byte("thumb_100"))
+	paths = up.CachePaths("x/Tea.PNG")
+	assert.Equal(t, len(paths), 2)
+	assert.Equal(t, paths[0], origin)
+	assert.Equal(t, paths[1], thumb)
+}
+
+func Test_CacheReader_ReadOnly(t *testing.T) {
+	root := upstreamCacheRoot("up_inspect_reader")
+	os.RemoveAll(root)
+
+	reader := NewCacheReader("up_inspect_reader", &upstreamConfig{
+		Buffers: &buffer.Config{Count: 2, Min: 4096, Max: 4096},
+	})
+
+	localPath := reader.upstream.LocalResPath("main.css", ".css")
+	w, err := DiskStore{}.Create(localPath)
+	assert.Nil(t, err)
+	assert.Nil(t, BuildRemoteResponse().Body("body").RemotePath("main.css").Response().Serialize(w))
+	assert.Nil(t, w.Commit())
+
+	// looks like it was left behind by a crash, but a live server could still
+	// be writing it
+	tempPath := filepath.Join(filepath.Dir(localPath), TEMP_FILE_PREFIX+"1.css.res")
+	assert.Nil(t, os.WriteFile(tempPath, []byte("x"), 0600))
+	old := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(tempPath, old, old))
+
+	stats, err := reader.CacheStats()
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Entries, 1)
+
+	entry, err := reader.InspectCache(localPath)
+	assert.Nil(t, err)
+	assert.Equal(t, entry.RemotePath, "main.css")
+
+	_, err = os.Stat(tempPath)
+	assert.Nil(t, err)
+	_, err = os.Stat(root + "tags.idx")
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = reader.upstream.store.Create(localPath)
+	assert.Equal(t, err, ErrReadOnlyStore)
+	assert.Equal(t, reader.upstream.store.Remove(localPath), ErrReadOnlyStore)
+}
+
+func testInspectUpstream(name string) *Upstream {
+	up, err := NewUpstream(name, &upstreamConfig{
+		Store:   "memory",
+		BaseURL: "https://www.goblgobl.com/docs/",
+		Buffers: &buffer.Config{Count: 2, Min: 4096, Max: 4096},
+		Transforms: map[string][]string{
+			"thumb_100": []string{"--size", "100x150"},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return up
+}
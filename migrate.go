@@ -0,0 +1,265 @@
+package assets
+
+import (
+	"encoding/base64"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"src.goblgobl.com/utils/log"
+)
+
+const (
+	// written to the cache root once every legacy file has been migrated, so
+	// that we don't scan the whole cache on every startup
+	MIGRATED_MARKER = "migrated"
+)
+
+// Cache files used to be named by the base64 encoded remote path (the
+// "base64" cache_layout). When an upstream uses the hash layout, existing
+// files are moved to their new name in the background on startup, so that
+// switching layouts doesn't throw away a warm cache.
+func (u *Upstream) Migrator() {
+	marker := string(u.cacheRoot) + MIGRATED_MARKER
+	if u.legacyNames {
+		// new entries get legacy names, they'll need migrating if we ever
+		// switch (back) to the hash layout
+		if err := u.store.Remove(marker); err != nil && !os.IsNotExist(err) {
+			log.Error("Upstream.Migrate.marker").Field(u.logField).Err(err).Log()
+		}
+		return
+	}
+
+	if _, err := u.store.Stat(marker); err == nil {
+		return
+	}
+
+	start := time.Now()
+	migrated, err := u.MigrateLegacyCache()
+	if err != nil {
+		log.Error("Upstream.Migrate").Field(u.logField).Err(err).Log()
+		return
+	}
+
+	// a file which couldn't be migrated is left where it is, it's only a
+	// cache miss (and it'll eventually be swept or evicted)
+	if w, err := u.store.Create(marker); err != nil {
+		log.Error("Upstream.Migrate.marker").Field(u.logField).Err(err).Log()
+	} else if err := w.Commit(); err != nil {
+		log.Error("Upstream.Migrate.marker").Field(u.logField).Err(err).Log()
+	}
+
+	if migrated > 0 {
+		log.Info("migrate").
+			Field(u.logField).
+			Int("migrated", migrated).
+			Int("ms", int(time.Since(start).Milliseconds())).
+			Log()
+	}
+}
+
+// Moves every cache file named by the legacy (base64) layout to the name
+// the current layout gives it. Files already using the current layout are
+// left as-is. Returns the number of entries moved.
+func (u *Upstream) MigrateLegacyCache() (int, error) {
+	migrated := 0
+	err := u.store.List(string(u.cacheRoot), func(metaPath string, info StoreInfo) error {
+		if !strings.HasSuffix(metaPath, ".res") {
+			return nil
+		}
+		if u.migrateLegacy(metaPath) {
+			migrated += 1
+		}
+		return nil
+	})
+	if err != nil {
+		return migrated, log.Err(ERR_CACHE_MIGRATE, err).String("root", string(u.cacheRoot))
+	}
+	return migrated, nil
+}
+
+func (u *Upstream) migrateLegacy(metaPath string) bool {
+	f, err := u.store.Open(metaPath)
+	if err != nil {
+		// could have been removed since we listed the directory
+		return false
+	}
+	defer f.Close()
+
+	meta, err := MetaFromReader(u, f, true)
+	if err != nil {
+		log.Warn("Upstream.Migrate.meta").Field(u.logField).String("path", metaPath).Err(err).Log()
+		return false
+	}
+
+	remotePath, xform, extension, ok := u.parseLegacyName(metaPath, meta.remotePath)
+	if !ok {
+		return false
+	}
+
+	var newMetaPath, newImagePath string
+	if isImageExtension(extension) {
+		var x []byte
+		if xform != "" {
+			x = []byte(xform)
+		}
+		newMetaPath, newImagePath = u.LocalImagePath(remotePath, extension, x)
+	} else {
+		newMetaPath = u.LocalResPath(remotePath, extension)
+	}
+
+	if newMetaPath == metaPath {
+		return false
+	}
+
+	// If something's already at the new path, it was fetched since we started
+	// and is newer than what we have.
+	if _, err := u.store.Stat(newMetaPath); err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Upstream.Migrate.stat").Field(u.logField).String("path", newMetaPath).Err(err).Log()
+			return false
+		}
+		if !u.migrateFiles(meta, f, metaPath, newMetaPath, newImagePath, remotePath) {
+			return false
+		}
+	}
+
+	if _, err := removeCacheFiles(u.store, metaPath); err != nil {
+		log.Error("Upstream.Migrate.remove").Field(u.logField).String("path", metaPath).Err(err).Log()
+	}
+	u.diskCache.Remove(metaPath)
+	u.hotCache.Delete(metaPath)
+	return true
+}
+
+// f is positioned right after the meta (which, for non-images, is where the
+// body starts)
+func (u *Upstream) migrateFiles(meta *Meta, f io.Reader, metaPath string, newMetaPath string, newImagePath string, remotePath string) bool {
+	store := u.store
+	size := int64(0)
+
+	// image first, meta last (see SaveOriginImage)
+	if newImagePath != "" {
+		imagePath := metaPath[:len(metaPath)-4]
+		n, err := u.copyStoreFile(imagePath, newImagePath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Error("Upstream.Migrate.image").Field(u.logField).String("path", imagePath).Err(err).Log()
+				return false
+			}
+			// a meta without an image is a cached non-image response (e.g. a 404)
+		}
+		size = n
+	}
+
+	w, err := store.Create(newMetaPath)
+	if err != nil {
+		log.Error("Upstream.Migrate.create").Field(u.logField).String("path", newMetaPath).Err(err).Log()
+		return false
+	}
+
+	meta.remotePath = remotePath
+	if err := meta.Serialize(w); err != nil {
+		w.Abort()
+		log.Error("Upstream.Migrate.serialize").Field(u.logField).String("path", newMetaPath).Err(err).Log()
+		return false
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Abort()
+		log.Error("Upstream.Migrate.body").Field(u.logField).String("path", metaPath).Err(err).Log()
+		return false
+	}
+	if err := w.Commit(); err != nil {
+		log.Error("Upstream.Migrate.commit").Field(u.logField).String("path", newMetaPath).Err(err).Log()
+		return false
+	}
+
+	if info, err := store.Stat(newMetaPath); err == nil {
+		size += info.Size
+	}
+	u.diskCache.Add(newMetaPath, size)
+	return true
+}
+
+func (u *Upstream) copyStoreFile(from string, to string) (int64, error) {
+	in, err := u.store.Open(from)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := u.store.Create(to)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(out, in)
+	if err != nil {
+		out.Abort()
+		return 0, err
+	}
+	return n, out.Commit()
+}
+
+// A legacy filename is base64(remotePath) + ["_" + xform] + extension + ".res"
+// Since '_' is part of the base64 url alphabet, we can only tell where the
+// encoded path ends by trying our configured transforms. Files written just
+// before the hash layout was introduced store the remote path in the meta,
+// which we prefer.
+func (u *Upstream) parseLegacyName(metaPath string, remotePath string) (string, string, string, bool) {
+	name := path.Base(metaPath)
+	name = name[:len(name)-4]
+
+	// base64 never produces a '.', so the first one is where the extension starts
+	stem, extension := name, ""
+	if i := strings.IndexByte(name, '.'); i != -1 {
+		stem, extension = name[:i], name[i:]
+	}
+
+	if remotePath != "" {
+		encoded := base64.RawURLEncoding.EncodeToString([]byte(remotePath))
+		if !strings.HasPrefix(stem, encoded) {
+			// already using the hash layout
+			return "", "", "", false
+		}
+		xform := stem[len(encoded):]
+		if xform == "" {
+			return remotePath, "", extension, true
+		}
+		if xform[0] != '_' {
+			return "", "", "", false
+		}
+		return remotePath, xform[1:], extension, true
+	}
+
+	if isImageExtension(extension) {
+		for xform := range u.transforms {
+			if !strings.HasSuffix(stem, "_"+xform) {
+				continue
+			}
+			encoded := stem[:len(stem)-len(xform)-1]
+			if remotePath, ok := decodeLegacyName(encoded, extension); ok {
+				return remotePath, xform, extension, true
+			}
+		}
+	}
+
+	if remotePath, ok := decodeLegacyName(stem, extension); ok {
+		return remotePath, "", extension, true
+	}
+	return "", "", "", false
+}
+
+func decodeLegacyName(encoded string, extension string) (string, bool) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	remotePath := string(decoded)
+	if remoteExtension(remotePath) != extension {
+		return "", false
+	}
+	return remotePath, true
+}
@@ -0,0 +1,134 @@
+package assets
+
+import (
+	"hash/crc32"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"src.goblgobl.com/tests/assert"
+	"src.goblgobl.com/tests/request"
+	"src.goblgobl.com/utils/buffer"
+	"src.goblgobl.com/utils/log"
+)
+
+func Test_Upstream_MigrateLegacyCache(t *testing.T) {
+	up, err := NewUpstream("up_migrate", &upstreamConfig{
+		Store:   "memory",
+		BaseURL: "https://www.goblgobl.com/docs/",
+		Buffers: &buffer.Config{Count: 2, Min: 4096, Max: 4096},
+		Transforms: map[string][]string{
+			"thumb_100": []string{"--size", "100x150"},
+		},
+	})
+	assert.Nil(t, err)
+	env := NewEnv(up)
+
+	legacy := *up
+	legacy.legacyNames = true
+
+	legacyResPath := legacy.LocalResPath("old/main.css", ".css")
+	assert.Nil(t, up.save(BuildRemoteResponse().Body("old css").Checksum().Response(), legacyResPath, env))
+
+	// '_' in both the path and the xform
+	legacyMetaPath, legacyImagePath := legacy.LocalImagePath("old/tea_cup.png", ".png", []byte("thumb_100"))
+	w, _ := up.store.Create(legacyImagePath)
+	w.Write([]byte("image"))
+	assert.Nil(t, w.Commit())
+	meta := &Meta{tpe: TYPE_IMAGE, status: 200, bodyLength: 5, expires: 4000000000}
+	meta.setChecksum(crc32.Checksum([]byte("image"), CRC32C))
+	assert.Nil(t, up.save(meta, legacyMetaPath, env))
+
+	// already using the hash layout
+	writeLocal(env, "new/main.css", BuildRemoteResponse().Body("new css").RemotePath("new/main.css").Response())
+
+	migrated, err := up.MigrateLegacyCache()
+	assert.Nil(t, err)
+	assert.Equal(t, migrated, 2)
+
+	for _, p := range []string{legacyResPath, legacyMetaPath, legacyImagePath} {
+		_, err := up.store.Stat(p)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	res := up.LoadLocalResponse(up.LocalResPath("old/main.css", ".css"), env, false)
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Body, "old css")
+	assert.Equal(t, res.(*LocalResponse).meta.remotePath, "old/main.css")
+
+	metaPath, imagePath := up.LocalImagePath("old/tea_cup.png", ".png", []byte("thumb_100"))
+	lr := up.LoadLocalImage(metaPath, imagePath, env)
+	assert.NotNil(t, lr)
+	assert.Equal(t, lr.meta.remotePath, "old/tea_cup.png")
+	conn = &fasthttp.RequestCtx{}
+	lr.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Body, "image")
+
+	// nothing left to migrate
+	migrated, err = up.MigrateLegacyCache()
+	assert.Nil(t, err)
+	assert.Equal(t, migrated, 0)
+}
+
+func Test_Upstream_MigrateLegacyCache_KeepsNewer(t *testing.T) {
+	up, err := NewUpstream("up_migrate2", &upstreamConfig{
+		Store:   "memory",
+		BaseURL: "https://www.goblgobl.com/docs/",
+		Buffers: &buffer.Config{Count: 2, Min: 4096, Max: 4096},
+	})
+	assert.Nil(t, err)
+	env := NewEnv(up)
+
+	legacy := *up
+	legacy.legacyNames = true
+	legacyPath := legacy.LocalResPath("main.css", ".css")
+	assert.Nil(t, up.save(BuildRemoteResponse().Body("old").Checksum().Response(), legacyPath, env))
+	localPath := writeLocal(env, "main.css", BuildRemoteResponse().Body("new").Checksum().RemotePath("main.css").Response())
+
+	migrated, err := up.MigrateLegacyCache()
+	assert.Nil(t, err)
+	assert.Equal(t, migrated, 1)
+
+	_, err = up.store.Stat(legacyPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, strings.HasSuffix(readStoreFile(up.store, localPath), "new"))
+}
+
+func Test_Upstream_Migrator_Marker(t *testing.T) {
+	up, err := NewUpstream("up_migrate3", &upstreamConfig{
+		Store:   "memory",
+		BaseURL: "https://www.goblgobl.com/docs/",
+		Buffers: &buffer.Config{Count: 2, Min: 4096, Max: 4096},
+	})
+	assert.Nil(t, err)
+	env := NewEnv(up)
+	marker := string(up.cacheRoot) + MIGRATED_MARKER
+
+	legacy := *up
+	legacy.legacyNames = true
+	legacyPath := legacy.LocalResPath("a.css", ".css")
+	assert.Nil(t, up.save(BuildRemoteResponse().Body("a").Checksum().Response(), legacyPath, env))
+
+	up.Migrator()
+	_, err = up.store.Stat(legacyPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = up.store.Stat(marker)
+	assert.Nil(t, err)
+
+	// already migrated, the cache isn't scanned again
+	legacyPath = legacy.LocalResPath("b.css", ".css")
+	assert.Nil(t, up.save(BuildRemoteResponse().Body("b").Checksum().Response(), legacyPath, env))
+	up.Migrator()
+	_, err = up.store.Stat(legacyPath)
+	assert.Nil(t, err)
+
+	// switching to the legacy layout means we'll need to migrate again
+	legacy.Migrator()
+	_, err = up.store.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+	up.Migrator()
+	_, err = up.store.Stat(legacyPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -3,9 +3,10 @@ package assets
 import (
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"io"
 	gohttp "net/http"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/valyala/fasthttp"
@@ -24,6 +25,7 @@ var (
 	ErrInvalidResponseType         = errors.New("serialized response is an unknown type")
 	ErrInvalidResponseVersion      = errors.New("serialized response is an unsuported version")
 	BIN_ENCODER                    = binary.LittleEndian
+	CRC32C                         = crc32.MakeTable(crc32.Castagnoli)
 )
 
 type Serializable interface {
@@ -37,24 +39,120 @@ type Meta struct {
 	cacheControl string
 	expires      uint32
 	bodyLength   uint32
+
+	// Additional upstream response headers (based on the upstream's configured
+	// allowlist) which we replay to the client
+	headers []MetaHeader
+
+	// CRC32C of the body, used to detect truncated or corrupted cache files.
+	// Files written before we stored checksums don't have one.
+	checksum    uint32
+	hasChecksum bool
+
+	// The remote path this was fetched from. Cache filenames are a hash of the
+	// path, so this is the only way to know what a cache file is for. Empty
+	// for files written before we stored it.
+	remotePath string
+
+	// The upstream's validators, used to revalidate the entry once it expires.
+	// For a transformed image, these are the validators of its origin.
+	etag         string
+	lastModified string
+
+	// From the upstream's Surrogate-Key or Cache-Tag header. This isn't
+	// serialized, it's only used to populate our TagIndex.
+	tags []string
+
+	// The larger of the response's own stale-while-revalidate and
+	// stale-if-error directives, in seconds. It's part of our fixed header
+	// (derived from cacheControl when serialized), so that the sweeper keeps
+	// the entry around for as long as it can be served.
+	stale uint32
+}
+
+type MetaHeader struct {
+	name  string
+	value string
 }
 
 // Don't rely on res.ContentLength for the bodyLength, it isn't reliable.
 // (It can be unknown (aka 0) to the gohttp.Response). Let our caller
-// give us the length explicitly (it probably read the body)
-func MetaFromResponse(res *gohttp.Response, ttl uint32, tpe byte, bodyLength uint32) *Meta {
+// give us the length explicitly (it probably read the body).
+// headers is the list of (canonical) header names to keep.
+func MetaFromResponse(res *gohttp.Response, ttl uint32, tpe byte, bodyLength uint32, headers []string) *Meta {
 	h := res.Header
 	expires := uint32(time.Now().Add(time.Duration(ttl) * time.Second).Unix())
+
+	var kept []MetaHeader
+	for _, name := range headers {
+		if values := h[name]; len(values) > 0 {
+			kept = append(kept, MetaHeader{name: name, value: strings.Join(values, ", ")})
+		}
+	}
+
 	return &Meta{
 		tpe:          tpe,
 		expires:      expires,
 		bodyLength:   bodyLength,
+		headers:      kept,
 		status:       uint16(res.StatusCode),
 		contentType:  h.Get("Content-Type"),
 		cacheControl: h.Get("Cache-Control"),
+		tags:         parseTags(h.Get("Surrogate-Key"), h.Get("Cache-Tag")),
+		etag:         h.Get("ETag"),
+		lastModified: h.Get("Last-Modified"),
+	}
+}
+
+func (m *Meta) canRevalidate() bool {
+	return m.etag != "" || m.lastModified != ""
+}
+
+// Called with a 304 Not Modified response from the upstream. The body we
+// have is still good, it's only our expiry (and whichever headers the
+// upstream chose to resend) that change.
+func (m *Meta) revalidated(res *gohttp.Response, ttl uint32) {
+	h := res.Header
+	m.expires = uint32(time.Now().Add(time.Duration(ttl) * time.Second).Unix())
+	if cc := h.Get("Cache-Control"); cc != "" {
+		m.cacheControl = cc
+	}
+	if etag := h.Get("ETag"); etag != "" {
+		m.etag = etag
+	}
+	if lastModified := h.Get("Last-Modified"); lastModified != "" {
+		m.lastModified = lastModified
+	}
+	for i, header := range m.headers {
+		if values := h[header.name]; len(values) > 0 {
+			m.headers[i].value = strings.Join(values, ", ")
+		}
 	}
 }
 
+// Every version starts with the same 17 byte header:
+//
+//	[0:2]   magic number (1, 1)
+//	[2:4]   version (0, 1), (0, 2) or (0, 3)
+//	[4]     type
+//	[5:9]   expires
+//	[9:11]  status
+//	[11:13] v1: content type length and cache control length (1 byte each)
+//	        v2+: length of the header block
+//	[13:17] body length
+//
+// which, in v3, is followed by:
+//
+//	[17:21] stale (see Meta.stale)
+//
+// In v1, the header is followed by the content type and then the cache control.
+// In v2+, the header is followed by a block of headers, each being:
+//
+//	name length (1 byte), name, value length (2 bytes), value
+//
+// Header names that start with ':' are reserved for our own metadata and
+// are never sent to the client. Before v3, stale can only be derived from the
+// Cache-Control header, so the headers are read even if readHeaders is false.
 func MetaFromReader(upstream *Upstream, r io.Reader, readHeaders bool) (*Meta, error) {
 	var header [17]byte
 	n, err := r.Read(header[:])
@@ -70,74 +168,237 @@ func MetaFromReader(upstream *Upstream, r io.Reader, readHeaders bool) (*Meta, e
 		return nil, ErrInvalidResponseType
 	}
 
-	if header[2] != 0 || header[3] != 1 {
+	version := header[3]
+	if header[2] != 0 || version < 1 || version > 3 {
 		return nil, ErrInvalidResponseVersion
 	}
 
-	contentTypeLength := header[11]
-	cacheControlLength := header[12]
-	var contentType, cacheControl string
+	meta := &Meta{
+		tpe:        header[4],
+		expires:    BIN_ENCODER.Uint32(header[5:]),
+		status:     BIN_ENCODER.Uint16(header[9:]),
+		bodyLength: BIN_ENCODER.Uint32(header[13:]),
+	}
 
-	if readHeaders && (contentTypeLength > 0 || cacheControlLength > 0) {
-		buffer := upstream.buffers.Checkout()
-		defer buffer.Release()
-		// this should not be able to fail, since our config enforces buffers are
-		// configured with at least 255 bytes
-		scrap, _ := buffer.TakeBytes(255)
+	if version == 3 {
+		var stale [4]byte
+		if _, err := io.ReadFull(r, stale[:]); err != nil {
+			return nil, ErrInvalidResponseHeaderLength
+		}
+		meta.stale = BIN_ENCODER.Uint32(stale[:])
+		if !readHeaders {
+			return meta, nil
+		}
+	}
 
-		if contentTypeLength > 0 {
-			ct := scrap[:contentTypeLength]
-			if n, _ := r.Read(ct); n > 0 {
-				contentType = string(ct)
-			}
+	if version == 1 {
+		meta.readV1Headers(upstream, r, header[11], header[12])
+	} else if err := meta.readHeaderBlock(r, BIN_ENCODER.Uint16(header[11:])); err != nil {
+		return nil, err
+	}
+
+	if version != 3 {
+		meta.stale = meta.staleDirectives()
+	}
+	return meta, nil
+}
+
+func (m *Meta) readV1Headers(upstream *Upstream, r io.Reader, contentTypeLength byte, cacheControlLength byte) {
+	if contentTypeLength == 0 && cacheControlLength == 0 {
+		return
+	}
+
+	buffer := upstream.buffers.Checkout()
+	defer buffer.Release()
+	// this should not be able to fail, since our config enforces buffers are
+	// configured with at least 255 bytes
+	scrap, _ := buffer.TakeBytes(255)
+
+	if contentTypeLength > 0 {
+		ct := scrap[:contentTypeLength]
+		if n, _ := r.Read(ct); n > 0 {
+			m.contentType = string(ct)
 		}
-		if cacheControlLength > 0 {
-			cc := scrap[:cacheControlLength]
-			if n, _ := r.Read(cc); n > 0 {
-				cacheControl = string(cc)
-			}
+	}
+	if cacheControlLength > 0 {
+		cc := scrap[:cacheControlLength]
+		if n, _ := r.Read(cc); n > 0 {
+			m.cacheControl = string(cc)
 		}
 	}
+}
 
-	return &Meta{
-		tpe:          header[4],
-		expires:      BIN_ENCODER.Uint32(header[5:]),
-		status:       BIN_ENCODER.Uint16(header[9:]),
-		contentType:  contentType,
-		cacheControl: cacheControl,
-		bodyLength:   BIN_ENCODER.Uint32(header[13:]),
-	}, nil
+func (m *Meta) readHeaderBlock(r io.Reader, length uint16) error {
+	if length == 0 {
+		return nil
+	}
+
+	// Our strings will all point into this block, which saves allocating
+	// each of them individually
+	block := make([]byte, length)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return err
+	}
+
+	for len(block) > 0 {
+		nameLength := int(block[0])
+		if nameLength == 0 || len(block) < nameLength+3 {
+			return ErrInvalidResponseHeaderLength
+		}
+		name := utils.B2S(block[1 : nameLength+1])
+		block = block[nameLength+1:]
+
+		valueLength := int(BIN_ENCODER.Uint16(block))
+		if len(block) < valueLength+2 {
+			return ErrInvalidResponseHeaderLength
+		}
+		value := utils.B2S(block[2 : valueLength+2])
+		block = block[valueLength+2:]
+
+		switch name {
+		case "Content-Type":
+			m.contentType = value
+		case "Cache-Control":
+			m.cacheControl = value
+		case ":crc32c":
+			if len(value) == 4 {
+				m.checksum = BIN_ENCODER.Uint32(utils.S2B(value))
+				m.hasChecksum = true
+			}
+		case ":path":
+			m.remotePath = value
+		case ":etag":
+			m.etag = value
+		case ":last-modified":
+			m.lastModified = value
+		default:
+			if name[0] != ':' {
+				m.headers = append(m.headers, MetaHeader{name: name, value: value})
+			}
+		}
+	}
+	return nil
 }
 
 func (m *Meta) Serialize(w io.Writer) error {
-	var header [17]byte
+	// 21 for our fixed header, 64 is a guess for our header block
+	data := make([]byte, 21, 85)
 
 	// magic number so we can tell this type of response apart from a raw image
-	header[0] = 1
-	header[1] = 1
+	data[0] = 1
+	data[1] = 1
 
 	// version
-	// header[2] = 0
-	header[3] = 1
-	header[4] = m.tpe
+	// data[2] = 0
+	data[3] = 3
+	data[4] = m.tpe
 
-	BIN_ENCODER.PutUint32(header[5:], m.expires)
-	BIN_ENCODER.PutUint16(header[9:], m.status)
-	header[11] = byte(len(m.contentType))
-	header[12] = byte(len(m.cacheControl))
-	BIN_ENCODER.PutUint32(header[13:], m.bodyLength)
+	BIN_ENCODER.PutUint32(data[5:], m.expires)
+	BIN_ENCODER.PutUint16(data[9:], m.status)
+	BIN_ENCODER.PutUint32(data[13:], m.bodyLength)
+	BIN_ENCODER.PutUint32(data[17:], m.staleDirectives())
 
-	if _, err := w.Write(header[:]); err != nil {
-		return err
+	if ct := m.contentType; ct != "" {
+		data = appendMetaHeader(data, "Content-Type", ct)
+	}
+	if cc := m.cacheControl; cc != "" {
+		data = appendMetaHeader(data, "Cache-Control", cc)
+	}
+	if m.hasChecksum {
+		var checksum [4]byte
+		BIN_ENCODER.PutUint32(checksum[:], m.checksum)
+		data = appendMetaHeader(data, ":crc32c", utils.B2S(checksum[:]))
+	}
+	if p := m.remotePath; p != "" {
+		data = appendMetaHeader(data, ":path", p)
+	}
+	if etag := m.etag; etag != "" {
+		data = appendMetaHeader(data, ":etag", etag)
+	}
+	if lm := m.lastModified; lm != "" {
+		data = appendMetaHeader(data, ":last-modified", lm)
 	}
+	for _, header := range m.headers {
+		data = appendMetaHeader(data, header.name, header.value)
+	}
+	BIN_ENCODER.PutUint16(data[11:], uint16(len(data)-21))
 
-	if _, err := w.Write(utils.S2B(m.contentType)); err != nil {
-		return err
+	_, err := w.Write(data)
+	return err
+}
+
+// Headers which don't fit (because of our 1 byte name length, 2 byte value
+// length or 2 byte total length) are silently dropped
+func appendMetaHeader(data []byte, name string, value string) []byte {
+	nameLength := len(name)
+	valueLength := len(value)
+	if nameLength == 0 || nameLength > 255 || valueLength > 65535 {
+		return data
 	}
-	if _, err := w.Write(utils.S2B(m.cacheControl)); err != nil {
-		return err
+	if len(data)-21+nameLength+valueLength+3 > 65535 {
+		return data
+	}
+
+	data = append(data, byte(nameLength))
+	data = append(data, name...)
+	data = BIN_ENCODER.AppendUint16(data, uint16(valueLength))
+	return append(data, value...)
+}
+
+func (m *Meta) staleDirectives() uint32 {
+	cc := m.cacheControl
+	swr := cacheControlSeconds(cc, "stale-while-revalidate=")
+	if sie := cacheControlSeconds(cc, "stale-if-error="); sie > swr {
+		return sie
+	}
+	return swr
+}
+
+// The value of a Cache-Control directive, like "max-age=", in seconds (0 if
+// the directive isn't there)
+func cacheControlSeconds(cc string, directive string) uint32 {
+	if n := strings.Index(cc, directive); n != -1 {
+		return atoi(cc[n+len(directive):])
+	}
+	return 0
+}
+
+func (m *Meta) setChecksum(checksum uint32) {
+	m.checksum = checksum
+	m.hasChecksum = true
+}
+
+// Checks that the next bodyLength bytes of f match our checksum. f's position
+// is restored, so that the body can then be served.
+func (m *Meta) checksumMatches(f io.ReadSeeker) bool {
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false
+	}
+
+	hasher := crc32.New(CRC32C)
+	if _, err := io.CopyN(hasher, f, int64(m.bodyLength)); err != nil {
+		// most likely a truncated file
+		return false
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return false
+	}
+	return hasher.Sum32() == m.checksum
+}
+
+func (m *Meta) writeHeaders(conn *fasthttp.RequestCtx) {
+	header := &conn.Response.Header
+	if ct := m.contentType; ct != "" {
+		header.SetContentType(ct)
+	}
+	if cc := m.cacheControl; cc != "" {
+		header.SetBytesK([]byte("Cache-Control"), cc)
+	}
+	for _, h := range m.headers {
+		header.Set(h.name, h.value)
 	}
-	return nil
 }
 
 // A response that's based on an net/http.Response from a GET to the upstream.
@@ -149,10 +410,14 @@ type RemoteResponse struct {
 	buffer *buffer.Buffer
 }
 
-func NewRemoteResponse(res *gohttp.Response, buf *buffer.Buffer, ttl uint32, tpe byte) *RemoteResponse {
+func NewRemoteResponse(res *gohttp.Response, buf *buffer.Buffer, ttl uint32, tpe byte, headers []string) *RemoteResponse {
+	meta := MetaFromResponse(res, ttl, tpe, uint32(buf.Len()), headers)
+	body, _ := buf.Bytes()
+	meta.setChecksum(crc32.Checksum(body, CRC32C))
+
 	return &RemoteResponse{
 		buffer: buf,
-		meta:   MetaFromResponse(res, ttl, tpe, uint32(buf.Len())),
+		meta:   meta,
 	}
 }
 
@@ -162,14 +427,7 @@ func (r *RemoteResponse) Write(conn *fasthttp.RequestCtx, logger log.Logger) log
 	bodyLength := int(meta.bodyLength)
 
 	conn.SetStatusCode(status)
-
-	header := &conn.Response.Header
-	if ct := meta.contentType; ct != "" {
-		header.SetContentType(ct)
-	}
-	if cc := meta.cacheControl; cc != "" {
-		header.SetBytesK([]byte("Cache-Control"), cc)
-	}
+	meta.writeHeaders(conn)
 
 	conn.SetBodyStream(r, bodyLength)
 
@@ -199,16 +457,73 @@ func (r *RemoteResponse) Serialize(w io.Writer) error {
 	return err
 }
 
+// A response that's too large to cache (see the upstream's max_object_size).
+// The upstream's body is streamed straight to the client.
+type PassThroughResponse struct {
+	meta *Meta
+	body io.Reader
+	// -1 when unknown
+	length int
+	// called once the body has been written (or discarded)
+	close func() error
+}
+
+func (r *PassThroughResponse) Write(conn *fasthttp.RequestCtx, logger log.Logger) log.Logger {
+	meta := r.meta
+	status := int(meta.status)
+
+	conn.SetStatusCode(status)
+	meta.writeHeaders(conn)
+	conn.Response.Header.Set("X-Cache", "PASS")
+
+	// SetBodyStream will close us
+	conn.SetBodyStream(r, r.length)
+
+	return logger.
+		Bool("hit", false).
+		Bool("pass_through", true).
+		Int("res", r.length).
+		Int("status", status)
+}
+
+func (r *PassThroughResponse) Read(p []byte) (int, error) {
+	return r.body.Read(p)
+}
+
+func (r *PassThroughResponse) Close() error {
+	return r.close()
+}
+
+// A meta in front of a body we already have: the body of an entry that the
+// upstream revalidated (304), read from its existing cache file
+type storedResponse struct {
+	meta *Meta
+	body io.Reader
+}
+
+func (r storedResponse) Serialize(w io.Writer) error {
+	if err := r.meta.Serialize(w); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, r.body, int64(r.meta.bodyLength))
+	return err
+}
+
 // A response which is loaded from the local file system. Or a "cached" response
 // We expect most responses to be a LocalResponse, because we expect heavy caching.
 type LocalResponse struct {
-	hit      bool
-	meta     *Meta
-	file     *os.File
-	upstream *Upstream
+	hit   bool
+	hot   bool
+	stale bool
+
+	// stale because the upstream failed (as opposed to stale-while-revalidate)
+	staleIfError bool
+	meta         *Meta
+	file         StoreFile
+	upstream     *Upstream
 }
 
-func NewLocalResponse(upstream *Upstream, file *os.File, readHeaders bool) (*LocalResponse, error) {
+func NewLocalResponse(upstream *Upstream, file StoreFile, readHeaders bool) (*LocalResponse, error) {
 	meta, err := MetaFromReader(upstream, file, readHeaders)
 	if err != nil {
 		return nil, err
@@ -232,12 +547,15 @@ func (r *LocalResponse) Write(conn *fasthttp.RequestCtx, logger log.Logger) log.
 	bodyLength := int(meta.bodyLength)
 
 	conn.SetStatusCode(status)
-	header := &conn.Response.Header
-	if ct := meta.contentType; ct != "" {
-		header.SetContentType(ct)
-	}
-	if cc := meta.cacheControl; cc != "" {
-		header.SetBytesK([]byte("Cache-Control"), cc)
+	meta.writeHeaders(conn)
+	if r.stale {
+		header := &conn.Response.Header
+		header.Set("X-Cache", "STALE")
+		if r.staleIfError {
+			header.Set("Warning", `111 - "Revalidation Failed"`)
+		} else {
+			header.Set("Warning", `110 - "Response is Stale"`)
+		}
 	}
 
 	// SetBodyStream will close the file
@@ -245,6 +563,9 @@ func (r *LocalResponse) Write(conn *fasthttp.RequestCtx, logger log.Logger) log.
 
 	return logger.
 		Bool("hit", r.hit).
+		Bool("hot", r.hot).
+		Bool("stale", r.stale).
+		Bool("stale_if_error", r.staleIfError).
 		Int("res", bodyLength).
 		Int("status", status)
 }
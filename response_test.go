@@ -2,7 +2,9 @@ package assets
 
 import (
 	"bytes"
+	"hash/crc32"
 	gohttp "net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,6 +20,10 @@ func Test_Meta_Serialize_And_Read(t *testing.T) {
 		bodyLength:   345,
 		contentType:  "a/type",
 		cacheControl: "forever",
+		headers: []MetaHeader{
+			MetaHeader{name: "ETag", value: `"abc"`},
+			MetaHeader{name: "Vary", value: strings.Repeat("a", 1000)},
+		},
 	}
 
 	b := new(bytes.Buffer)
@@ -31,6 +37,11 @@ func Test_Meta_Serialize_And_Read(t *testing.T) {
 	assert.Equal(t, m2.bodyLength, 345)
 	assert.Equal(t, m2.contentType, "a/type")
 	assert.Equal(t, m2.cacheControl, "forever")
+	assert.Equal(t, len(m2.headers), 2)
+	assert.Equal(t, m2.headers[0].name, "ETag")
+	assert.Equal(t, m2.headers[0].value, `"abc"`)
+	assert.Equal(t, m2.headers[1].name, "Vary")
+	assert.Equal(t, m2.headers[1].value, strings.Repeat("a", 1000))
 
 	b.Reset()
 	assert.Nil(t, m1.Serialize(b))
@@ -42,6 +53,150 @@ func Test_Meta_Serialize_And_Read(t *testing.T) {
 	assert.Equal(t, m3.bodyLength, 345)
 	assert.Equal(t, m3.contentType, "")
 	assert.Equal(t, m3.cacheControl, "")
+	assert.Equal(t, len(m3.headers), 0)
+}
+
+func Test_Meta_Serialize_And_Read_Stale(t *testing.T) {
+	m1 := &Meta{status: 200, cacheControl: "max-age=10, stale-while-revalidate=60, stale-if-error=600"}
+
+	b := new(bytes.Buffer)
+	assert.Nil(t, m1.Serialize(b))
+
+	// part of the fixed header
+	m2, err := MetaFromReader(testUpstream2(), b, false)
+	assert.Nil(t, err)
+	assert.Equal(t, m2.stale, 600)
+	assert.Equal(t, m2.cacheControl, "")
+}
+
+func Test_Meta_Read_V2_Stale(t *testing.T) {
+	b := bytes.NewBuffer([]byte{
+		1, 1, 0, 2, // magic + version
+		0,           // type
+		12, 0, 0, 0, // expires
+		200, 0, // status
+		33, 0, // header block length
+		0, 0, 0, 0, // body length
+	})
+	b.Write([]byte{13})
+	b.WriteString("Cache-Control")
+	b.Write([]byte{17, 0})
+	b.WriteString("stale-if-error=90")
+
+	// the headers are read regardless, it's the only way to know
+	m, err := MetaFromReader(testUpstream2(), b, false)
+	assert.Nil(t, err)
+	assert.Equal(t, m.cacheControl, "stale-if-error=90")
+	assert.Equal(t, m.stale, 90)
+}
+
+func Test_Meta_Serialize_And_Read_Checksum(t *testing.T) {
+	m1 := &Meta{status: 200}
+	m1.setChecksum(0x01020304)
+
+	b := new(bytes.Buffer)
+	assert.Nil(t, m1.Serialize(b))
+
+	m2, err := MetaFromReader(testUpstream2(), b, true)
+	assert.Nil(t, err)
+	assert.True(t, m2.hasChecksum)
+	assert.Equal(t, m2.checksum, 0x01020304)
+	// internal metadata isn't exposed as a header
+	assert.Equal(t, len(m2.headers), 0)
+}
+
+func Test_Meta_Serialize_And_Read_RemotePath(t *testing.T) {
+	m1 := &Meta{status: 200, remotePath: "a/long/path/over.png"}
+
+	b := new(bytes.Buffer)
+	assert.Nil(t, m1.Serialize(b))
+
+	m2, err := MetaFromReader(testUpstream2(), b, true)
+	assert.Nil(t, err)
+	assert.Equal(t, m2.remotePath, "a/long/path/over.png")
+	assert.Equal(t, len(m2.headers), 0)
+}
+
+func Test_Meta_Serialize_And_Read_Validators(t *testing.T) {
+	m1 := &Meta{status: 200, etag: `"v1"`, lastModified: "Wed, 21 Oct 2015 07:28:00 GMT"}
+
+	b := new(bytes.Buffer)
+	assert.Nil(t, m1.Serialize(b))
+
+	m2, err := MetaFromReader(testUpstream2(), b, true)
+	assert.Nil(t, err)
+	assert.True(t, m2.canRevalidate())
+	assert.Equal(t, m2.etag, `"v1"`)
+	assert.Equal(t, m2.lastModified, "Wed, 21 Oct 2015 07:28:00 GMT")
+	assert.Equal(t, len(m2.headers), 0)
+
+	assert.False(t, (&Meta{status: 200}).canRevalidate())
+}
+
+func Test_Meta_Revalidated(t *testing.T) {
+	m := &Meta{
+		status:       200,
+		expires:      10,
+		cacheControl: "max-age=10",
+		etag:         `"v1"`,
+		headers:      []MetaHeader{{name: "Vary", value: "Accept"}, {name: "X-Other", value: "1"}},
+	}
+
+	res := &gohttp.Response{StatusCode: 304, Header: gohttp.Header{}}
+	res.Header.Set("Cache-Control", "max-age=60")
+	res.Header.Set("ETag", `"v2"`)
+	res.Header.Set("Vary", "Accept-Encoding")
+	m.revalidated(res, 60)
+
+	assert.Delta(t, m.expires, uint32(time.Now().Unix()+60), 2)
+	assert.Equal(t, m.status, 200)
+	assert.Equal(t, m.cacheControl, "max-age=60")
+	assert.Equal(t, m.etag, `"v2"`)
+	assert.Equal(t, m.headers[0].value, "Accept-Encoding")
+	assert.Equal(t, m.headers[1].value, "1")
+}
+
+func Test_Meta_Read_V1(t *testing.T) {
+	b := bytes.NewBuffer([]byte{
+		1, 1, 0, 1, // magic + version
+		1,           // type
+		12, 0, 0, 0, // expires
+		200, 0, // status
+		6, 7, // content type & cache control length
+		99, 0, 0, 0, // body length
+	})
+	b.WriteString("a/typeforever")
+
+	m, err := MetaFromReader(testUpstream2(), b, true)
+	assert.Nil(t, err)
+	assert.Equal(t, m.tpe, 1)
+	assert.Equal(t, m.status, 200)
+	assert.Equal(t, m.expires, 12)
+	assert.Equal(t, m.bodyLength, 99)
+	assert.Equal(t, m.contentType, "a/type")
+	assert.Equal(t, m.cacheControl, "forever")
+	assert.Equal(t, len(m.headers), 0)
+}
+
+func Test_Meta_Read_InvalidVersion(t *testing.T) {
+	b := bytes.NewBuffer([]byte{1, 1, 0, 9, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	_, err := MetaFromReader(testUpstream2(), b, true)
+	assert.Equal(t, err, ErrInvalidResponseVersion)
+}
+
+func Test_Meta_Read_EmptyHeaderName(t *testing.T) {
+	b := bytes.NewBuffer([]byte{
+		1, 1, 0, 2, // magic + version
+		1,           // type
+		12, 0, 0, 0, // expires
+		200, 0, // status
+		4, 0, // header block length
+		0, 0, 0, 0, // body length
+	})
+	// a header with an empty name and a 1 byte value
+	b.Write([]byte{0, 1, 0, 'x'})
+	_, err := MetaFromReader(testUpstream2(), b, true)
+	assert.Equal(t, err, ErrInvalidResponseHeaderLength)
 }
 
 func Test_Meta_FromResponse(t *testing.T) {
@@ -50,15 +205,29 @@ func Test_Meta_FromResponse(t *testing.T) {
 		Header: gohttp.Header{
 			"Content-Type":  []string{"over/9000"},
 			"Cache-Control": []string{"public,max-age=9001"},
+			"Surrogate-Key": []string{"p1 p2"},
+			"Etag":          []string{`"e1"`},
+			"Vary":          []string{"Accept", "Origin"},
+			"Server":        []string{"nope"},
 		},
 	}
-	m := MetaFromResponse(res, 300, 100, 999)
+	m := MetaFromResponse(res, 300, 100, 999, []string{"Etag", "Vary", "Last-Modified"})
 	assert.Equal(t, m.tpe, 100)
 	assert.Equal(t, m.status, 800)
 	assert.Delta(t, m.expires, uint32(time.Now().Unix()+300), 1)
 	assert.Equal(t, m.bodyLength, 999)
 	assert.Equal(t, m.contentType, "over/9000")
 	assert.Equal(t, m.cacheControl, "public,max-age=9001")
+	assert.Equal(t, len(m.tags), 2)
+	assert.Equal(t, m.tags[0], "p1")
+	assert.Equal(t, m.tags[1], "p2")
+	assert.Equal(t, len(m.headers), 2)
+	assert.Equal(t, m.headers[0].name, "Etag")
+	assert.Equal(t, m.headers[0].value, `"e1"`)
+	assert.Equal(t, m.headers[1].name, "Vary")
+	assert.Equal(t, m.headers[1].value, "Accept, Origin")
+	assert.Equal(t, m.etag, `"e1"`)
+	assert.Equal(t, m.lastModified, "")
 }
 
 type RemoteResponseBuilder struct {
@@ -111,3 +280,25 @@ func (rb *RemoteResponseBuilder) Image() *RemoteResponseBuilder {
 	rb.response.meta.tpe = TYPE_IMAGE
 	return rb
 }
+
+func (rb *RemoteResponseBuilder) Header(name string, value string) *RemoteResponseBuilder {
+	rb.response.meta.headers = append(rb.response.meta.headers, MetaHeader{name: name, value: value})
+	return rb
+}
+
+func (rb *RemoteResponseBuilder) Checksum() *RemoteResponseBuilder {
+	body, _ := rb.response.buffer.Bytes()
+	rb.response.meta.bodyLength = uint32(len(body))
+	rb.response.meta.setChecksum(crc32.Checksum(body, CRC32C))
+	return rb
+}
+
+func (rb *RemoteResponseBuilder) RemotePath(remotePath string) *RemoteResponseBuilder {
+	rb.response.meta.remotePath = remotePath
+	return rb
+}
+
+func (rb *RemoteResponseBuilder) ETag(etag string) *RemoteResponseBuilder {
+	rb.response.meta.etag = etag
+	return rb
+}
@@ -0,0 +1,100 @@
+package assets
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	gohttp "net/http"
+	"time"
+)
+
+const (
+	RETRY_NETWORK = "network"
+	RETRY_TIMEOUT = "timeout"
+)
+
+// When and how often a failed request to the upstream is retried. The zero
+// value never retries.
+type RetryPolicy struct {
+	// total attempts, including the first one
+	attempts   int
+	statuses   map[int]struct{}
+	network    bool
+	timeout    bool
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// no new attempt is started once this much time has passed since the first
+	// and an attempt still waiting on a response at that point is cut off
+	deadline time.Duration
+}
+
+func NewRetryPolicy(config *upstreamRetryConfig) RetryPolicy {
+	if config == nil || config.Attempts <= 1 {
+		return RetryPolicy{}
+	}
+
+	statuses := make(map[int]struct{}, len(config.Statuses))
+	for _, status := range config.Statuses {
+		statuses[status] = struct{}{}
+	}
+
+	policy := RetryPolicy{
+		attempts:   config.Attempts,
+		statuses:   statuses,
+		backoff:    time.Duration(config.BackoffMS) * time.Millisecond,
+		maxBackoff: time.Duration(config.MaxBackoffMS) * time.Millisecond,
+		deadline:   time.Duration(config.DeadlineMS) * time.Millisecond,
+	}
+	for _, e := range config.Errors {
+		switch e {
+		case RETRY_NETWORK:
+			policy.network = true
+		case RETRY_TIMEOUT:
+			policy.timeout = true
+		}
+	}
+	return policy
+}
+
+// res and err are the result of an attempt
+func (p RetryPolicy) retryable(res *gohttp.Response, err error) bool {
+	if err == nil {
+		_, retry := p.statuses[res.StatusCode]
+		return retry
+	}
+	if isTimeout(err) {
+		return p.timeout
+	}
+	return p.network
+}
+
+// Exponential backoff, with jitter so that a burst of failures (say, because
+// the upstream restarted) doesn't turn into a burst of retries.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.backoff << (attempt - 1)
+	if d <= 0 || (p.maxBackoff > 0 && d > p.maxBackoff) {
+		// <= 0 means we overflowed
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	// somewhere between half and all of d
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// An attempt cut off by the retry deadline. It's a timeout, so that it's
+// reported as one.
+var errRetryDeadline error = retryDeadlineError{}
+
+type retryDeadlineError struct{}
+
+func (retryDeadlineError) Error() string   { return "upstream retry deadline exceeded" }
+func (retryDeadlineError) Timeout() bool   { return true }
+func (retryDeadlineError) Temporary() bool { return false }
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
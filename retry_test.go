@@ -0,0 +1,57 @@
+package assets
+
+import (
+	"errors"
+	gohttp "net/http"
+	"os"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_RetryPolicy_Disabled(t *testing.T) {
+	assert.Equal(t, NewRetryPolicy(nil).attempts, 0)
+	assert.Equal(t, NewRetryPolicy(&upstreamRetryConfig{Attempts: 1}).attempts, 0)
+}
+
+func Test_RetryPolicy_Retryable(t *testing.T) {
+	policy := NewRetryPolicy(&upstreamRetryConfig{
+		Attempts: 3,
+		Statuses: []int{503},
+		Errors:   []string{RETRY_TIMEOUT},
+	})
+
+	assert.True(t, policy.retryable(&gohttp.Response{StatusCode: 503}, nil))
+	assert.False(t, policy.retryable(&gohttp.Response{StatusCode: 500}, nil))
+	assert.False(t, policy.retryable(&gohttp.Response{StatusCode: 200}, nil))
+	assert.True(t, policy.retryable(nil, os.ErrDeadlineExceeded))
+	assert.False(t, policy.retryable(nil, errors.New("connection reset by peer")))
+
+	policy.network = true
+	assert.True(t, policy.retryable(nil, errors.New("connection reset by peer")))
+}
+
+func Test_RetryPolicy_Delay(t *testing.T) {
+	policy := NewRetryPolicy(&upstreamRetryConfig{
+		Attempts:     10,
+		BackoffMS:    100,
+		MaxBackoffMS: 500,
+	})
+
+	for i := 0; i < 20; i++ {
+		d := policy.delay(1)
+		assert.True(t, d >= 50*time.Millisecond && d <= 100*time.Millisecond)
+
+		d = policy.delay(2)
+		assert.True(t, d >= 100*time.Millisecond && d <= 200*time.Millisecond)
+
+		// capped
+		d = policy.delay(8)
+		assert.True(t, d >= 250*time.Millisecond && d <= 500*time.Millisecond)
+
+		// overflowed
+		d = policy.delay(70)
+		assert.True(t, d >= 250*time.Millisecond && d <= 500*time.Millisecond)
+	}
+}
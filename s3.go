@@ -0,0 +1,229 @@
+package assets
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	gohttp "net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// sha256 of an empty payload, we only ever GET
+	S3_EMPTY_PAYLOAD = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// the most of an error body we'll read looking for its code
+	S3_MAX_ERROR_BODY = 4096
+)
+
+// Signs requests to an S3-compatible bucket (AWS Signature Version 4) and
+// turns "this key doesn't exist" responses into plain 404s, so that they end
+// up in our NotFoundCache rather than being cached as S3's XML error.
+type s3Transport struct {
+	next            gohttp.RoundTripper
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	// buckets without s3:ListBucket return a 403 for missing keys
+	forbiddenAsNotFound bool
+
+	// for tests
+	now func() time.Time
+}
+
+func newS3Transport(config *upstreamS3Config, next gohttp.RoundTripper) *s3Transport {
+	return &s3Transport{
+		next:                next,
+		region:              config.Region,
+		accessKeyID:         config.AccessKeyID,
+		secretAccessKey:     config.SecretAccessKey,
+		sessionToken:        config.SessionToken,
+		forbiddenAsNotFound: config.ForbiddenAsNotFound,
+		now:                 time.Now,
+	}
+}
+
+// The base URL of the bucket
+func s3BaseURL(config *upstreamS3Config) string {
+	endpoint := strings.TrimSuffix(config.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+
+	if config.PathStyle {
+		return endpoint + "/" + config.Bucket + "/"
+	}
+
+	// virtual-hosted: https://BUCKET.s3.REGION.amazonaws.com/
+	scheme, host, found := strings.Cut(endpoint, "://")
+	if !found {
+		return "https://" + config.Bucket + "." + endpoint + "/"
+	}
+	return scheme + "://" + config.Bucket + "." + host + "/"
+}
+
+func (t *s3Transport) RoundTrip(req *gohttp.Request) (*gohttp.Response, error) {
+	if scheme := req.URL.Scheme; scheme != "http" && scheme != "https" {
+		return t.next.RoundTrip(req)
+	}
+
+	// RoundTrippers mustn't modify the request
+	req = req.Clone(req.Context())
+	t.sign(req, t.now())
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	status := res.StatusCode
+	if status == 404 || (status == 403 && t.forbiddenAsNotFound) {
+		if status == 404 || s3ErrorCode(res) == "AccessDenied" {
+			res.Body.Close()
+			res.StatusCode = 404
+			res.Status = "404 Not Found"
+			res.Header.Del("Content-Type")
+			res.Header.Del("Content-Length")
+			res.ContentLength = 0
+			res.Body = io.NopCloser(strings.NewReader(""))
+		}
+	}
+	return res, nil
+}
+
+func (t *s3Transport) sign(req *gohttp.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	header := req.Header
+	header.Set("X-Amz-Date", amzDate)
+	header.Set("X-Amz-Content-Sha256", S3_EMPTY_PAYLOAD)
+	if token := t.sessionToken; token != "" {
+		header.Set("X-Amz-Security-Token", token)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	// We sign the host, range and all of the x-amz-* headers. Whatever else
+	// we send (conditional headers, custom request_headers) isn't signed,
+	// which S3 allows.
+	signed := map[string]string{"host": host}
+	for name, values := range header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	signedHeaders := strings.Join(names, ";")
+
+	// The path has to be encoded the way S3 expects, and sent exactly as we
+	// signed it
+	canonicalURI := s3Encode(req.URL.Path, false)
+	req.URL.RawPath = canonicalURI
+
+	var canonical bytes.Buffer
+	canonical.WriteString(req.Method)
+	canonical.WriteByte('\n')
+	canonical.WriteString(canonicalURI)
+	canonical.WriteByte('\n')
+	canonical.WriteString(s3CanonicalQuery(req.URL.Query()))
+	canonical.WriteByte('\n')
+	for _, name := range names {
+		canonical.WriteString(name)
+		canonical.WriteByte(':')
+		canonical.WriteString(signed[name])
+		canonical.WriteByte('\n')
+	}
+	canonical.WriteByte('\n')
+	canonical.WriteString(signedHeaders)
+	canonical.WriteByte('\n')
+	canonical.WriteString(S3_EMPTY_PAYLOAD)
+
+	scope := date + "/" + t.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256(canonical.Bytes())
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+t.secretAccessKey), date)
+	key = hmacSHA256(key, t.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+t.accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(query))
+	for key, values := range query {
+		key = s3Encode(key, true)
+		for _, value := range values {
+			pairs = append(pairs, key+"="+s3Encode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// URI encoding as SigV4 defines it: everything but unreserved characters (and,
+// for paths, the slash) is percent-encoded
+func s3Encode(s string, encodeSlash bool) string {
+	const hexChars = "0123456789ABCDEF"
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexChars[c>>4])
+		b.WriteByte(hexChars[c&15])
+	}
+	return b.String()
+}
+
+// The <Code> of an S3 XML error response (the body is replaced, so that it
+// can still be read)
+func s3ErrorCode(res *gohttp.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, S3_MAX_ERROR_BODY))
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	start := bytes.Index(body, []byte("<Code>"))
+	if start == -1 {
+		return ""
+	}
+	body = body[start+6:]
+	end := bytes.Index(body, []byte("</Code>"))
+	if end == -1 {
+		return ""
+	}
+	return string(body[:end])
+}
@@ -1,9 +1,11 @@
 package assets
 
 import (
+	"bytes"
+	"crypto/subtle"
 	_ "embed"
-	"path/filepath"
 	"runtime"
+	"strings"
 
 	"src.goblgobl.com/utils"
 	"src.goblgobl.com/utils/http"
@@ -14,10 +16,13 @@ import (
 )
 
 var (
-	resNotFoundPath   = http.StaticNotFound(RES_UNKNOWN_ROUTE)
-	resMissingUpParam = http.StaticError(400, RES_MISSING_UP_PARAM, "up parameter is required")
-	resUnknownUpParam = http.StaticError(400, RES_UNKNOWN_UP_PARAM, "up parameter is not valid")
-	resInvalidXForm   = http.StaticError(400, RES_INVALID_XFORM_PARAM, "invalid xform parameter")
+	resNotFoundPath     = http.StaticNotFound(RES_UNKNOWN_ROUTE)
+	resMissingUpParam   = http.StaticError(400, RES_MISSING_UP_PARAM, "up parameter is required")
+	resUnknownUpParam   = http.StaticError(400, RES_UNKNOWN_UP_PARAM, "up parameter is not valid")
+	resInvalidXForm     = http.StaticError(400, RES_INVALID_XFORM_PARAM, "invalid xform parameter")
+	resUnauthorized     = http.StaticError(401, RES_UNAUTHORIZED, "unauthorized")
+	resInvalidWarmList  = http.StaticError(400, RES_INVALID_WARM_LIST, "body must be a list of paths or a sitemap")
+	resTooManyWarmPaths = http.StaticError(400, RES_TOO_MANY_WARM_PATHS, "too many paths, send them in batches")
 	//go:generate make commit.txt
 	//go:embed commit.txt
 	commit string
@@ -52,6 +57,19 @@ func handler() func(ctx *fasthttp.RequestCtx) {
 	// asset proxy routes
 	r.GET("/v1/{path:*}", http.Handler("v1", loadEnv, AssetHandler))
 
+	// admin routes
+	if Config.Admin.Key != "" {
+		purge := http.Handler("purge", loadAdminEnv, PurgeHandler)
+		r.DELETE("/v1/{path:*}", purge)
+		r.Handle("PURGE", "/v1/{path:*}", purge)
+
+		purgeTag := http.Handler("purge_tag", loadAdminEnv, PurgeTagHandler)
+		r.DELETE("/tags/{tag}", purgeTag)
+		r.Handle("PURGE", "/tags/{tag}", purgeTag)
+
+		r.POST("/warm", http.Handler("warm", loadAdminEnv, WarmHandler))
+	}
+
 	// catch all
 	r.NotFound = func(ctx *fasthttp.RequestCtx) {
 		resNotFoundPath.Write(ctx, log.Request("404"))
@@ -75,13 +93,42 @@ func loadEnv(conn *fasthttp.RequestCtx) (*Env, http.Response, error) {
 	return NewEnv(upstream), nil, nil
 }
 
+func loadAdminEnv(conn *fasthttp.RequestCtx) (*Env, http.Response, error) {
+	key := Config.Admin.Key
+	if key == "" {
+		return nil, resUnauthorized, nil
+	}
+
+	auth := conn.Request.Header.Peek("Authorization")
+	if len(auth) != len(key)+7 || string(auth[:7]) != "Bearer " {
+		return nil, resUnauthorized, nil
+	}
+
+	if subtle.ConstantTimeCompare(auth[7:], utils.S2B(key)) != 1 {
+		return nil, resUnauthorized, nil
+	}
+
+	return loadEnv(conn)
+}
+
+type upstreamInfo struct {
+	Breaker BreakerStatus `json:"breaker"`
+}
+
 func InfoHandler(conn *fasthttp.RequestCtx) (http.Response, error) {
+	upstreams := make(map[string]upstreamInfo, len(Upstreams))
+	for name, upstream := range Upstreams {
+		upstreams[name] = upstreamInfo{Breaker: upstream.breaker.Status()}
+	}
+
 	return http.OK(struct {
-		Go     string `json:"go"`
-		Commit string `json:"commit"`
+		Go        string                  `json:"go"`
+		Commit    string                  `json:"commit"`
+		Upstreams map[string]upstreamInfo `json:"upstreams"`
 	}{
-		Commit: commit,
-		Go:     runtime.Version(),
+		Commit:    commit,
+		Go:        runtime.Version(),
+		Upstreams: upstreams,
 	}), nil
 }
 
@@ -90,16 +137,96 @@ func PingHandler(conn *fasthttp.RequestCtx) (http.Response, error) {
 }
 
 func AssetHandler(conn *fasthttp.RequestCtx, env *Env) (http.Response, error) {
-	remotePath := conn.UserValue("path").(string)
+	requestPath := conn.UserValue("path").(string)
+	remotePath := env.upstream.RemotePath(requestPath, string(conn.URI().QueryString()))
 	env.requestLogger.String("path", remotePath)
 
-	extension := lowercase(filepath.Ext(remotePath))
-	switch extension {
-	case ".png", ".jpg", ".gif", ".webp":
+	extension := remoteExtension(requestPath)
+	if isImageExtension(extension) {
 		return serveImage(conn, env, remotePath, extension)
-	default:
-		return serveStatic(conn, env, remotePath, extension)
 	}
+	return serveStatic(conn, env, remotePath, extension)
+}
+
+// Removes the cached response for the path, including, for images, the
+// origin and every transformed variant.
+func PurgeHandler(conn *fasthttp.RequestCtx, env *Env) (http.Response, error) {
+	requestPath := conn.UserValue("path").(string)
+	remotePath := env.upstream.RemotePath(requestPath, string(conn.URI().QueryString()))
+	env.requestLogger.String("path", remotePath)
+
+	removed, err := env.upstream.Purge(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	return purgeResponse(removed), nil
+}
+
+// Removes every asset that the upstream tagged (Surrogate-Key or Cache-Tag)
+// with the tag
+func PurgeTagHandler(conn *fasthttp.RequestCtx, env *Env) (http.Response, error) {
+	tag := conn.UserValue("tag").(string)
+	env.requestLogger.String("tag", tag)
+
+	removed, err := env.upstream.PurgeTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	return purgeResponse(removed), nil
+}
+
+// Warms the cache with the paths (one per line, or a sitemap) in the body.
+// Optional xform (comma separated) and concurrency query parameters. The
+// response is sent once every path has been processed, so a request can have
+// at most MAX_WARM_PATHS paths.
+func WarmHandler(conn *fasthttp.RequestCtx, env *Env) (http.Response, error) {
+	upstream := env.upstream
+	query := conn.QueryArgs()
+
+	var xforms []string
+	if xform := query.Peek("xform"); len(xform) > 0 {
+		xforms = strings.Split(string(xform), ",")
+		for _, name := range xforms {
+			if _, exists := upstream.transforms[name]; !exists {
+				return resInvalidXForm, nil
+			}
+		}
+	}
+
+	concurrency, _ := query.GetUint("concurrency")
+	if concurrency > MAX_WARM_CONCURRENCY {
+		concurrency = MAX_WARM_CONCURRENCY
+	}
+
+	paths, err := upstream.ParseWarmList(bytes.NewReader(conn.PostBody()))
+	if err != nil {
+		return resInvalidWarmList, nil
+	}
+	env.requestLogger.Int("paths", len(paths))
+	if len(paths) > MAX_WARM_PATHS {
+		return resTooManyWarmPaths, nil
+	}
+
+	// Warm calls this from one goroutine at a time
+	results := make([]WarmResult, 0, len(paths))
+	summary, err := upstream.Warm(paths, xforms, concurrency, func(result WarmResult) {
+		results = append(results, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return http.OK(WarmResponse{WarmSummary: summary, Results: results}), nil
+}
+
+func purgeResponse(removed []string) http.Response {
+	if removed == nil {
+		removed = []string{}
+	}
+	return http.OK(struct {
+		Removed []string `json:"removed"`
+	}{
+		Removed: removed,
+	})
 }
 
 func serveImage(conn *fasthttp.RequestCtx, env *Env, remotePath string, extension string) (http.Response, error) {
@@ -115,19 +242,47 @@ func serveImage(conn *fasthttp.RequestCtx, env *Env, remotePath string, extensio
 		}
 	}
 
+	return loadImage(env, remotePath, extension, xform, xformArgs)
+}
+
+// Serves the image (or its transformed variant when xform is set) from the
+// cache, fetching the origin and transforming it as needed. Also used to
+// warm the cache.
+func loadImage(env *Env, remotePath string, extension string, xform []byte, xformArgs []string) (http.Response, error) {
+	upstream := env.upstream
 	localMetaPath, localImagePath := upstream.LocalImagePath(remotePath, extension, xform)
 
 	if res := upstream.LoadLocalImage(localMetaPath, localImagePath, env); res != nil {
 		// We have a local response for this request. Hopefully it's the image
 		// that was asked for, but it could be anything else that the upstream
 		// returned previously that we've now cached (e.g. a 404)
+		if res.stale {
+			// the request's buffers are reused once we've responded
+			remotePath := strings.Clone(remotePath)
+			xform := bytes.Clone(xform)
+			upstream.RefreshInBackground(localMetaPath, func(env *Env) (http.Response, error) {
+				return fetchImage(env, remotePath, extension, xform, xformArgs)
+			})
+		}
 		return res, nil
 	}
 
+	return fetchImage(env, remotePath, extension, xform, xformArgs)
+}
+
+// The part of loadImage that happens when we don't have the image (or its
+// transform) or it's expired.
+func fetchImage(env *Env, remotePath string, extension string, xform []byte, xformArgs []string) (http.Response, error) {
+	upstream := env.upstream
+	localMetaPath, localImagePath := upstream.LocalImagePath(remotePath, extension, xform)
+
 	if xform == nil {
 		// no tranform and from the previous failed LoadLocalImage, we know we
 		// don't have the image.
 		res, _, err := upstream.SaveOriginImage(remotePath, localMetaPath, localImagePath, env)
+		if err == errServeStale {
+			return loadStaleImage(env, remotePath, extension, nil)
+		}
 		if res != nil || err != nil {
 			// As an optimization, SaveOriginImage will return the RemoteResponse or
 			// LocalResponse if the upstream returned a non-image, we can return that
@@ -159,6 +314,17 @@ func serveImage(conn *fasthttp.RequestCtx, env *Env, remotePath string, extensio
 	if expires == 0 {
 		// we don't have the origin, let's get it
 		res, ex, err := upstream.SaveOriginImage(remotePath, originMetaPath, originImagePath, env)
+		if err == errServeStale {
+			return loadStaleImage(env, remotePath, extension, xform)
+		}
+		if pt, ok := res.(*PassThroughResponse); ok {
+			// too large to cache, so we have nothing to transform
+			pt.Close()
+			return nil, log.ErrData(ERR_OBJECT_TOO_LARGE, errObjectTooLarge, map[string]any{
+				"xform":  xform,
+				"remote": remotePath,
+			})
+		}
 		if res != nil || err != nil {
 			// We either got an error, or we got a non-image.
 			// If we got a non-image, then we'll return the response as though
@@ -170,7 +336,15 @@ func serveImage(conn *fasthttp.RequestCtx, env *Env, remotePath string, extensio
 		expires = ex
 	}
 
-	if err := upstream.TransformImage(originImagePath, localMetaPath, localImagePath, xformArgs, expires, env); err != nil {
+	// The transform might have expired while its origin is unchanged, in which
+	// case there's no need to generate it again
+	if upstream.RefreshTransform(originMetaPath, localMetaPath, localImagePath, expires, env) {
+		if res := upstream.LoadLocalImage(localMetaPath, localImagePath, env); res != nil {
+			return res, nil
+		}
+	}
+
+	if err := upstream.TransformImage(remotePath, originImagePath, localMetaPath, localImagePath, xformArgs, expires, env); err != nil {
 		return nil, log.ErrData(ERR_TRANSFORM, err, map[string]any{
 			"xform":  xform,
 			"remote": remotePath,
@@ -189,12 +363,50 @@ func serveImage(conn *fasthttp.RequestCtx, env *Env, remotePath string, extensio
 	})
 }
 
+// The upstream failed to give us the origin, but our expired copy of it is
+// still within its stale-if-error window. For a transform, we serve our
+// expired transform. If the origin isn't an image (a cached 403?), it's
+// served as-is.
+func loadStaleImage(env *Env, remotePath string, extension string, xform []byte) (http.Response, error) {
+	upstream := env.upstream
+	if xform != nil {
+		localMetaPath, localImagePath := upstream.LocalImagePath(remotePath, extension, xform)
+		if res := upstream.LoadStaleImage(localMetaPath, localImagePath, env); res != nil {
+			return res, nil
+		}
+	}
+
+	originMetaPath, originImagePath := upstream.LocalImagePath(remotePath, extension, nil)
+	if res := upstream.LoadStaleImage(originMetaPath, originImagePath, env); res != nil {
+		if xform == nil || res.Type() == TYPE_GENERIC {
+			return res, nil
+		}
+		res.Close()
+	}
+
+	return nil, log.ErrData(ERR_PROXY, errServeStale, map[string]any{
+		"remote": remotePath,
+		"xform":  xform,
+	})
+}
+
 func serveStatic(conn *fasthttp.RequestCtx, env *Env, remotePath string, extension string) (http.Response, error) {
+	return loadStatic(env, remotePath, extension)
+}
+
+func loadStatic(env *Env, remotePath string, extension string) (http.Response, error) {
 	upstream := env.upstream
 
 	localPath := upstream.LocalResPath(remotePath, extension)
 	lr := upstream.LoadLocalResponse(localPath, env, false)
 	if lr != nil {
+		if local, ok := lr.(*LocalResponse); ok && local.stale {
+			// the request's buffers are reused once we've responded
+			remotePath := strings.Clone(remotePath)
+			upstream.RefreshInBackground(localPath, func(env *Env) (http.Response, error) {
+				return upstream.GetResponseAndSave(remotePath, localPath, env)
+			})
+		}
 		return lr, nil
 	}
 
@@ -6,6 +6,7 @@ import (
 	"path"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 
 	"src.goblgobl.com/tests/assert"
@@ -32,6 +33,22 @@ func Test_InfoHandler_Ok(t *testing.T) {
 	assert.Equal(t, body.String("go"), runtime.Version())
 }
 
+func Test_InfoHandler_Breaker(t *testing.T) {
+	up2 := testUpstream2()
+	up2.breaker = NewCircuitBreaker(&upstreamBreakerConfig{Failures: 1})
+	up2.breaker.Record(true)
+	Upstreams = map[string]*Upstream{up2.name: up2}
+
+	conn := request.Req(t).Conn()
+	res, err := InfoHandler(conn)
+	assert.Nil(t, err)
+
+	res.Write(conn, log.Noop{})
+	breaker := request.Res(t, conn).OK().JSON().Object("upstreams").Object(up2.name).Object("breaker")
+	assert.Equal(t, breaker.String("state"), "open")
+	assert.True(t, breaker.String("opened_at") != "")
+}
+
 func Test_PingHandler_Ok(t *testing.T) {
 	conn := request.Req(t).Conn()
 	res, err := PingHandler(conn)
@@ -235,6 +252,178 @@ func Test_AssetHandler_Orign(t *testing.T) {
 	assert.Equal(t, res.SHA256(), "3d7d16e6a995fe2327b3d6090c1ea73ecc265edfea86b8ddfa655adbb363b063")
 }
 
+func Test_LoadAdminEnv_Unauthorized(t *testing.T) {
+	defer func() { Config.Admin.Key = "" }()
+
+	// admin disabled
+	conn := request.Req(t).Query("up", "up2_local").Header("Authorization", "Bearer ").Conn()
+	env, res, err := loadAdminEnv(conn)
+	assert.Nil(t, env)
+	assert.Nil(t, err)
+	res.Write(conn, log.Noop{})
+	request.Res(t, conn).ExpectStatus(401)
+
+	Config.Admin.Key = "secret"
+	for _, auth := range []string{"", "secret", "Bearer", "Bearer secreT", "Bearer secret2"} {
+		conn := request.Req(t).Query("up", "up2_local").Header("Authorization", auth).Conn()
+		env, res, err := loadAdminEnv(conn)
+		assert.Nil(t, env)
+		assert.Nil(t, err)
+		res.Write(conn, log.Noop{})
+		request.Res(t, conn).ExpectStatus(401)
+	}
+}
+
+func Test_LoadAdminEnv_Ok(t *testing.T) {
+	defer func() { Config.Admin.Key = "" }()
+	Config.Admin.Key = "secret"
+
+	up2 := testUpstream2()
+	Upstreams = map[string]*Upstream{up2.name: up2}
+
+	conn := request.Req(t).Query("up", up2.name).Header("Authorization", "Bearer secret").Conn()
+	env, res, err := loadAdminEnv(conn)
+	assert.Nil(t, res)
+	assert.Nil(t, err)
+	assert.Equal(t, env.upstream.name, up2.name)
+}
+
+func Test_PurgeHandler_Static(t *testing.T) {
+	env := NewEnv(testUpstream2())
+	localPath := writeLocal(env, "purge/main.css", BuildRemoteResponse().Body("hello").Response())
+
+	request.ReqT(t, env).
+		UserValue("path", "purge/main.css").
+		Get(PurgeHandler).
+		OK()
+	assert.False(t, fileExists(localPath))
+
+	// nothing left to purge, still ok
+	request.ReqT(t, env).
+		UserValue("path", "purge/main.css").
+		Get(PurgeHandler).
+		OK()
+}
+
+func Test_PurgeHandler_Image(t *testing.T) {
+	up := testUpstream2()
+	env := NewEnv(up)
+
+	originMeta, originImage := up.LocalImagePath("purge/tea.png", ".png", nil)
+	xformMeta, xformImage := up.LocalImagePath("purge/tea.png", ".png", []byte("thumb_100"))
+	for _, p := range []string{originImage, xformImage} {
+		os.MkdirAll(path.Dir(p), 0700)
+		os.WriteFile(p, []byte("image"), 0600)
+	}
+	meta := &Meta{tpe: TYPE_IMAGE, status: 200, bodyLength: 5}
+	assert.Nil(t, up.save(meta, originMeta, env))
+	assert.Nil(t, up.save(meta, xformMeta, env))
+	up.notFoundCache.Set(xformMeta, 100)
+
+	request.ReqT(t, env).
+		UserValue("path", "purge/tea.png").
+		Get(PurgeHandler).
+		OK()
+
+	for _, p := range []string{originMeta, originImage, xformMeta, xformImage} {
+		assert.False(t, fileExists(p))
+	}
+	assert.False(t, up.notFoundCache.Get(xformMeta))
+}
+
+func Test_PurgeHandler_QueryVariants(t *testing.T) {
+	up := testUpstream2()
+	env := NewEnv(up)
+
+	var localPaths []string
+	for _, remotePath := range []string{"purge/app.js", "purge/app.js?v=1", "purge/app.js?v=2", "purge/other.js?v=1"} {
+		localPath := up.LocalResPath(remotePath, ".js")
+		assert.Nil(t, up.save(BuildRemoteResponse().Body("1").Response(), localPath, env))
+		up.indexTags(remotePath, nil, env)
+		localPaths = append(localPaths, localPath)
+	}
+
+	request.ReqT(t, env).
+		UserValue("path", "purge/app.js").
+		Get(PurgeHandler).
+		OK()
+
+	assert.False(t, fileExists(localPaths[0]))
+	assert.False(t, fileExists(localPaths[1]))
+	assert.False(t, fileExists(localPaths[2]))
+	assert.True(t, fileExists(localPaths[3]))
+	assert.Equal(t, len(up.tagIndex.Get(queryVariantsTag("purge/app.js"))), 0)
+}
+
+func Test_PurgeTagHandler(t *testing.T) {
+	up := testUpstream2()
+	env := NewEnv(up)
+	p1 := writeLocal(env, "purge/tag1.css", BuildRemoteResponse().Body("1").Response())
+	p2 := writeLocal(env, "purge/tag2.css", BuildRemoteResponse().Body("2").Response())
+	p3 := writeLocal(env, "purge/tag3.css", BuildRemoteResponse().Body("3").Response())
+	up.tagIndex.Set("purge/tag1.css", []string{"product-1"})
+	up.tagIndex.Set("purge/tag2.css", []string{"product-1", "product-2"})
+	up.tagIndex.Set("purge/tag3.css", []string{"product-2"})
+
+	request.ReqT(t, env).
+		UserValue("tag", "product-1").
+		Get(PurgeTagHandler).
+		OK()
+
+	assert.False(t, fileExists(p1))
+	assert.False(t, fileExists(p2))
+	assert.True(t, fileExists(p3))
+	assert.Equal(t, len(up.tagIndex.Get("product-1")), 0)
+	// purge/tag2.css is gone, so it's no longer tagged with product-2 either
+	assert.Equal(t, len(up.tagIndex.Get("product-2")), 1)
+}
+
+func Test_WarmHandler_InvalidXForm(t *testing.T) {
+	env := NewEnv(testUpstream2())
+	request.ReqT(t, env).
+		Query("xform", "thumb_100,nope").
+		Body("tea.png").
+		Post(WarmHandler).
+		ExpectInvalid(202_004)
+}
+
+func Test_WarmHandler_InvalidBody(t *testing.T) {
+	env := NewEnv(testUpstream2())
+	request.ReqT(t, env).
+		Body("<urlset></urlset>").
+		Post(WarmHandler).
+		ExpectInvalid(202_007)
+}
+
+func Test_WarmHandler_TooManyPaths(t *testing.T) {
+	env := NewEnv(testUpstream2())
+	request.ReqT(t, env).
+		Body(strings.Repeat("warm/many.css\n", MAX_WARM_PATHS+1)).
+		Post(WarmHandler).
+		ExpectInvalid(202_008)
+}
+
+func Test_WarmHandler_Ok(t *testing.T) {
+	env := NewEnv(testUpstream2())
+	writeLocal(env, "warm/handler.css", BuildRemoteResponse().Body("1").Response())
+
+	body := request.ReqT(t, env).
+		Query("concurrency", "2").
+		Body("warm/handler.css\n").
+		Post(WarmHandler).
+		OK().JSON()
+	assert.Equal(t, body.Int("total"), 1)
+	assert.Equal(t, body.Int("cached"), 1)
+	assert.Equal(t, body.Int("failed"), 0)
+
+	// every result, not just the failures, so that the CLI can report each path
+	results := body["results"].([]any)
+	assert.Equal(t, len(results), 1)
+	result := results[0].(map[string]any)
+	assert.Equal(t, result["path"].(string), "warm/handler.css")
+	assert.Equal(t, result["result"].(string), WARM_CACHED)
+}
+
 func clearLocalCache() {
 	files, _ := ioutil.ReadDir(UP2_ROOT)
 	for _, file := range files {
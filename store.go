@@ -0,0 +1,325 @@
+package assets
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrReadOnlyStore = errors.New("store is read-only")
+
+const (
+	// Base64 (url) encoding never produces a '.', so none of our real cache
+	// files can start with this
+	TEMP_FILE_PREFIX = ".tmp."
+)
+
+// Where an upstream's cache files live. Paths are the full paths generated by
+// LocalResPath / LocalImagePath (so they include the upstream's cache root).
+type Store interface {
+	// Opens the file for reading. os.IsNotExist(err) is true when the file
+	// doesn't exist.
+	Open(path string) (StoreFile, error)
+
+	// Creates a file which only becomes visible, atomically, once it's
+	// committed. Until then, readers see the previous version (if any).
+	Create(path string) (StoreWriter, error)
+
+	// os.IsNotExist(err) is true when the file doesn't exist
+	Stat(path string) (StoreInfo, error)
+
+	// os.IsNotExist(err) is true when the file didn't exist
+	Remove(path string) error
+
+	// Calls fn for every committed file under root. If fn returns an error,
+	// the listing stops and the error is returned.
+	List(root string, fn func(path string, info StoreInfo) error) error
+}
+
+type StoreFile interface {
+	io.ReadSeekCloser
+}
+
+// WriteAt can only overwrite what was already written (e.g. to fill in a
+// header once the rest of the file is known). ReadAt reads back what was
+// written, up until Commit or Abort.
+type StoreWriter interface {
+	io.Writer
+	io.WriterAt
+	io.ReaderAt
+	Commit() error
+	Abort()
+}
+
+type StoreInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Implemented by stores whose files live on the local filesystem, which
+// lets vipsthumbnail read them in place.
+type FileStore interface {
+	FilePath(path string) string
+}
+
+func NewStore(tpe string) Store {
+	switch tpe {
+	case "memory":
+		return NewMemoryStore()
+	default:
+		return DiskStore{}
+	}
+}
+
+// Our cache files as files on the local filesystem, sharded into
+// directories (which are created as needed)
+type DiskStore struct{}
+
+func (s DiskStore) Open(p string) (StoreFile, error) {
+	return os.Open(p)
+}
+
+// Writes go to a temporary file in the same directory as the final path,
+// which is renamed into place on Commit. This way, readers never see a
+// partially written file, and a crash can only leave a temporary file behind
+// (which List cleans up).
+func (s DiskStore) Create(p string) (StoreWriter, error) {
+	dir, name := path.Split(p)
+
+	// The final name goes at the end so that the extension is preserved
+	// (vipsthumbnail relies on it to know what format to write)
+	pattern := TEMP_FILE_PREFIX + "*." + name
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		os.MkdirAll(dir, 0700)
+		f, err = os.CreateTemp(dir, pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &diskFile{File: f, path: p}, nil
+}
+
+func (s DiskStore) Stat(p string) (StoreInfo, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return StoreInfo{}, err
+	}
+	return StoreInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s DiskStore) Remove(p string) error {
+	return os.Remove(p)
+}
+
+// Temporary files which were left behind by a crash (older than an hour)
+// are removed as they're encountered.
+func (s DiskStore) List(root string, fn func(p string, info StoreInfo) error) error {
+	return listDisk(root, true, fn)
+}
+
+func (s DiskStore) FilePath(p string) string {
+	return p
+}
+
+func listDisk(root string, removeStaleTemp bool, fn func(p string, info StoreInfo) error) error {
+	staleTemp := time.Now().Add(-time.Hour)
+
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			// could have been removed since we listed the directory
+			return nil
+		}
+
+		if isTempFile(d.Name()) {
+			if removeStaleTemp && info.ModTime().Before(staleTemp) {
+				os.Remove(p)
+			}
+			return nil
+		}
+
+		return fn(p, StoreInfo{Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
+
+// A DiskStore that never changes anything: it can't create or remove files
+// and leaves temporary files alone when listing (a running server could be
+// writing them). For inspecting the cache of a live server.
+type readOnlyDiskStore struct {
+	DiskStore
+}
+
+func (s readOnlyDiskStore) Create(p string) (StoreWriter, error) {
+	return nil, ErrReadOnlyStore
+}
+
+func (s readOnlyDiskStore) Remove(p string) error {
+	return ErrReadOnlyStore
+}
+
+func (s readOnlyDiskStore) List(root string, fn func(p string, info StoreInfo) error) error {
+	return listDisk(root, false, fn)
+}
+
+type diskFile struct {
+	*os.File
+	path string
+}
+
+func (f *diskFile) Commit() error {
+	tmp := f.File.Name()
+	if err := f.File.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (f *diskFile) Abort() {
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, TEMP_FILE_PREFIX)
+}
+
+// Keeps everything in memory. Mostly useful for tests. Nothing is ever
+// evicted, unless max_cache_bytes is configured.
+type MemoryStore struct {
+	sync.RWMutex
+	files map[string]*memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		files: make(map[string]*memoryFile),
+	}
+}
+
+func (s *MemoryStore) Open(p string) (StoreFile, error) {
+	s.RLock()
+	f, exists := s.files[p]
+	s.RUnlock()
+	if !exists {
+		return nil, &fs.PathError{Op: "open", Path: p, Err: fs.ErrNotExist}
+	}
+	// data is never modified once committed, so it's safe to share
+	return memoryReader{bytes.NewReader(f.data)}, nil
+}
+
+func (s *MemoryStore) Create(p string) (StoreWriter, error) {
+	return &memoryWriter{store: s, path: p}, nil
+}
+
+func (s *MemoryStore) Stat(p string) (StoreInfo, error) {
+	s.RLock()
+	f, exists := s.files[p]
+	s.RUnlock()
+	if !exists {
+		return StoreInfo{}, &fs.PathError{Op: "stat", Path: p, Err: fs.ErrNotExist}
+	}
+	return StoreInfo{Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+func (s *MemoryStore) Remove(p string) error {
+	s.Lock()
+	_, exists := s.files[p]
+	delete(s.files, p)
+	s.Unlock()
+	if !exists {
+		return &fs.PathError{Op: "remove", Path: p, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+func (s *MemoryStore) List(root string, fn func(p string, info StoreInfo) error) error {
+	type entry struct {
+		path string
+		info StoreInfo
+	}
+
+	// don't hold the lock while calling fn, it might want to remove the file
+	s.RLock()
+	entries := make([]entry, 0, len(s.files))
+	for p, f := range s.files {
+		if strings.HasPrefix(p, root) {
+			entries = append(entries, entry{path: p, info: StoreInfo{Size: int64(len(f.data)), ModTime: f.modTime}})
+		}
+	}
+	s.RUnlock()
+
+	for _, e := range entries {
+		if err := fn(e.path, e.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (r memoryReader) Close() error {
+	return nil
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	path  string
+	store *MemoryStore
+}
+
+func (w *memoryWriter) Commit() error {
+	s := w.store
+	f := &memoryFile{data: w.Bytes(), modTime: time.Now()}
+	s.Lock()
+	s.files[w.path] = f
+	s.Unlock()
+	return nil
+}
+
+func (w *memoryWriter) WriteAt(p []byte, off int64) (int, error) {
+	data := w.Bytes()
+	if off < 0 || off+int64(len(p)) > int64(len(data)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(data[off:], p), nil
+}
+
+func (w *memoryWriter) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(w.Bytes()).ReadAt(p, off)
+}
+
+func (w *memoryWriter) Abort() {
+	w.Reset()
+}
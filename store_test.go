@@ -0,0 +1,121 @@
+package assets
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_DiskStore_CreateAndCommit(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "aa", "aabbcc.png")
+	testStoreCreateAndCommit(t, DiskStore{}, target)
+}
+
+func Test_DiskStore_TempFile(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "aa", "aabbcc.png")
+
+	w, err := DiskStore{}.Create(target)
+	assert.Nil(t, err)
+	name := w.(*diskFile).Name()
+	assert.True(t, isTempFile(filepath.Base(name)))
+	// vipsthumbnail relies on the extension being preserved
+	assert.Equal(t, filepath.Ext(name), ".png")
+
+	w.Abort()
+	assert.False(t, fileExists(name))
+}
+
+func Test_DiskStore_ListRemovesStaleTempFiles(t *testing.T) {
+	root := t.TempDir()
+	writeDiskCacheFile(root, "aa/aa1.res", 1)
+	fresh := writeDiskCacheFile(root, "aa/"+TEMP_FILE_PREFIX+"1.aa2.res", 1)
+	stale := writeDiskCacheFile(root, "aa/"+TEMP_FILE_PREFIX+"2.aa3.res", 1)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(stale, old, old)
+
+	var listed []string
+	err := DiskStore{}.List(root, func(p string, info StoreInfo) error {
+		listed = append(listed, p)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(listed), 1)
+	assert.Equal(t, listed[0], filepath.Join(root, "aa/aa1.res"))
+	assert.True(t, fileExists(fresh))
+	assert.False(t, fileExists(stale))
+}
+
+func Test_MemoryStore_CreateAndCommit(t *testing.T) {
+	testStoreCreateAndCommit(t, NewMemoryStore(), "root/aa/aabbcc.png")
+}
+
+func testStoreCreateAndCommit(t *testing.T, store Store, target string) {
+	t.Helper()
+
+	_, err := store.Open(target)
+	assert.True(t, os.IsNotExist(err))
+	_, err = store.Stat(target)
+	assert.True(t, os.IsNotExist(err))
+
+	w, err := store.Create(target)
+	assert.Nil(t, err)
+	w.Write([]byte("hello"))
+
+	// not visible until committed
+	_, err = store.Open(target)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, w.Commit())
+	assert.Equal(t, readStoreFile(store, target), "hello")
+
+	info, err := store.Stat(target)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size, 5)
+
+	w, err = store.Create(target)
+	assert.Nil(t, err)
+	w.Write([]byte("world"))
+	w.Abort()
+	// original is untouched
+	assert.Equal(t, readStoreFile(store, target), "hello")
+
+	// what's written can be read back and overwritten
+	w, err = store.Create(target)
+	assert.Nil(t, err)
+	w.Write([]byte("hello world"))
+	data := make([]byte, 5)
+	n, err := w.ReadAt(data, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data[:n]), "world")
+	_, err = w.WriteAt([]byte("HELLO"), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Commit())
+	assert.Equal(t, readStoreFile(store, target), "HELLO world")
+
+	var listed []string
+	err = store.List(filepath.Dir(filepath.Dir(target)), func(p string, info StoreInfo) error {
+		listed = append(listed, p)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(listed), 1)
+	assert.Equal(t, listed[0], target)
+
+	assert.Nil(t, store.Remove(target))
+	assert.True(t, os.IsNotExist(store.Remove(target)))
+	_, err = store.Open(target)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func readStoreFile(store Store, p string) string {
+	f, err := store.Open(p)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	return string(data)
+}
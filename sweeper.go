@@ -0,0 +1,106 @@
+package assets
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"src.goblgobl.com/utils/log"
+)
+
+// Runs forever, periodically deleting expired entries from the upstream's
+// cache. Without this, entries which are never requested again would stay
+// on disk forever (we only notice an expired entry when it's requested).
+func (u *Upstream) Sweeper() {
+	interval := u.sweepInterval
+	if interval == 0 {
+		return
+	}
+
+	for {
+		time.Sleep(interval)
+		start := time.Now()
+		removed, err := u.Sweep(u.sweepGrace)
+		if err != nil {
+			log.Error("Upstream.Sweep").Field(u.logField).Err(err).Log()
+		}
+		log.Info("sweep").
+			Field(u.logField).
+			Int("removed", removed).
+			Int("ms", int(time.Since(start).Milliseconds())).
+			Log()
+	}
+}
+
+// Lists our store and deletes every entry that expired more than grace
+// seconds ago (or longer ago than the response's own stale directives allow
+// it to be served for, if that's larger). Only the fixed-size header of each
+// meta file is read. Images left without a meta are deleted too. Returns the
+// number of files removed (an entry and its image count as 1).
+func (u *Upstream) Sweep(grace uint32) (int, error) {
+	removed := 0
+	start := time.Now()
+	now := start.Unix()
+
+	err := u.store.List(string(u.cacheRoot), func(metaPath string, info StoreInfo) error {
+		if !strings.HasSuffix(metaPath, ".res") {
+			if mayBeOrphanImage(metaPath, info, start) && u.sweepOrphan(metaPath) {
+				removed += 1
+			}
+			return nil
+		}
+
+		meta, ok := u.sweepMeta(metaPath)
+		if !ok {
+			return nil
+		}
+		window := grace
+		if meta.stale > window {
+			window = meta.stale
+		}
+		if int64(meta.expires)+int64(window) >= now {
+			return nil
+		}
+
+		if _, err := removeCacheFiles(u.store, metaPath); err != nil {
+			log.Error("Upstream.Sweep.remove").Field(u.logField).String("path", metaPath).Err(err).Log()
+			return nil
+		}
+		u.diskCache.Remove(metaPath)
+		u.forgetTags(metaPath)
+		removed += 1
+		return nil
+	})
+
+	return removed, err
+}
+
+// Removes the image if its meta doesn't exist
+func (u *Upstream) sweepOrphan(imagePath string) bool {
+	if _, err := u.store.Stat(imagePath + ".res"); !os.IsNotExist(err) {
+		return false
+	}
+	if err := u.store.Remove(imagePath); err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Upstream.Sweep.orphan").Field(u.logField).String("path", imagePath).Err(err).Log()
+		}
+		return false
+	}
+	return true
+}
+
+func (u *Upstream) sweepMeta(metaPath string) (*Meta, bool) {
+	f, err := u.store.Open(metaPath)
+	if err != nil {
+		// could have been removed since we listed the directory
+		return nil, false
+	}
+	defer f.Close()
+
+	meta, err := MetaFromReader(u, f, false)
+	if err != nil {
+		log.Warn("Upstream.Sweep.meta").Field(u.logField).String("path", metaPath).Err(err).Log()
+		return nil, false
+	}
+	return meta, true
+}
@@ -0,0 +1,78 @@
+package assets
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_Upstream_Sweep(t *testing.T) {
+	clearLocalCache()
+	up := testUpstream2()
+	env := NewEnv(up)
+
+	fresh := writeLocal(env, "sweep_fresh.css", BuildRemoteResponse().Expires(100).Response())
+	expired := writeLocal(env, "sweep_expired.css", BuildRemoteResponse().Expires(-100).Response())
+	recent := writeLocal(env, "sweep_recent.css", BuildRemoteResponse().Expires(-10).Response())
+
+	removed, err := up.Sweep(50)
+	assert.Nil(t, err)
+	assert.Equal(t, removed, 1)
+	assert.True(t, fileExists(fresh))
+	assert.False(t, fileExists(expired))
+
+	// within the grace period
+	assert.True(t, fileExists(recent))
+
+	removed, err = up.Sweep(0)
+	assert.Nil(t, err)
+	assert.Equal(t, removed, 1)
+	assert.True(t, fileExists(fresh))
+	assert.False(t, fileExists(recent))
+}
+
+func Test_Upstream_Sweep_StaleDirectives(t *testing.T) {
+	clearLocalCache()
+	up := testUpstream2()
+	env := NewEnv(up)
+
+	swr := writeLocal(env, "sweep_swr.css", BuildRemoteResponse().CacheControl("max-age=1, stale-while-revalidate=300").Expires(-100).Response())
+	sie := writeLocal(env, "sweep_sie.css", BuildRemoteResponse().CacheControl("max-age=1, stale-if-error=300").Expires(-100).Response())
+	short := writeLocal(env, "sweep_short.css", BuildRemoteResponse().CacheControl("max-age=1, stale-if-error=50").Expires(-100).Response())
+
+	// still servable, even though they're past the grace period
+	removed, err := up.Sweep(0)
+	assert.Nil(t, err)
+	assert.Equal(t, removed, 1)
+	assert.True(t, fileExists(swr))
+	assert.True(t, fileExists(sie))
+	assert.False(t, fileExists(short))
+}
+
+func Test_Upstream_Sweep_OrphanImages(t *testing.T) {
+	clearLocalCache()
+	up := testUpstream2()
+	env := NewEnv(up)
+
+	old := time.Now().Add(-2 * time.Hour)
+	metaPath, imagePath := up.LocalImagePath("sweep_image.png", ".png", nil)
+	assert.Nil(t, up.save(BuildRemoteResponse().Image().Response(), metaPath, env))
+	image := writeDiskCacheFile("", imagePath, 10)
+	_, orphanPath := up.LocalImagePath("sweep_orphan.png", ".png", nil)
+	orphan := writeDiskCacheFile("", orphanPath, 10)
+	_, recentPath := up.LocalImagePath("sweep_recent.png", ".png", nil)
+	recent := writeDiskCacheFile("", recentPath, 10)
+	for _, p := range []string{metaPath, image, orphan} {
+		os.Chtimes(p, old, old)
+	}
+
+	removed, err := up.Sweep(0)
+	assert.Nil(t, err)
+	assert.Equal(t, removed, 1)
+	assert.True(t, fileExists(image))
+	assert.False(t, fileExists(orphan))
+	// its meta could still be on its way
+	assert.True(t, fileExists(recent))
+}
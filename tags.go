@@ -0,0 +1,368 @@
+package assets
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// the log is only compacted once it has at least this many more records
+	// than the index has entries (on top of being twice as large)
+	TAG_INDEX_COMPACT_MIN = 1024
+)
+
+// A persistent tag => remote paths index, used to purge every asset that the
+// upstream tagged (via a Surrogate-Key or Cache-Tag header) in one go. We
+// index the remote path rather than the individual cache files, since every
+// cache file (including image transforms) can be derived from it. The query
+// variants of a path are also grouped under an internal tag (see
+// queryVariantsTag).
+//
+// The index is stored as an append-only log, one record per line:
+//
+//	tag\t"path"   the (quoted) path is tagged with tag
+//	\t"path"      the path was removed (from every tag)
+//	tag\t         the tag was removed
+//
+// Tags can't contain tabs or newlines (see parseTags). The log is compacted
+// when it's loaded, and whenever it grows to more than twice the size of the
+// index.
+//
+// The log isn't a cache entry, so it's deliberately written to the local
+// filesystem directly rather than through the upstream's Store. An index
+// without a path (for a store that isn't on the filesystem, whose entries
+// don't survive a restart anyway) is only kept in memory.
+type TagIndex struct {
+	sync.Mutex
+	path string
+	file *os.File
+
+	// tag => remote paths
+	tags map[string]map[string]struct{}
+
+	// remote path => tags
+	paths map[string]map[string]struct{}
+
+	// the meta path of a remote path's main cache entry => remote path, so
+	// that an entry which is evicted or swept can be dropped from the index
+	// (see Upstream.primaryMetaPath). Nil when metaPath is nil.
+	metaPath  func(remotePath string) string
+	metaPaths map[string]string
+
+	// the number of records in the log, and the number of tag => path
+	// entries that they add up to
+	records int
+	entries int
+}
+
+func NewTagIndex(path string, metaPath func(remotePath string) string) (*TagIndex, error) {
+	t := &TagIndex{
+		path:     path,
+		tags:     make(map[string]map[string]struct{}),
+		paths:    make(map[string]map[string]struct{}),
+		metaPath: metaPath,
+	}
+	if metaPath != nil {
+		t.metaPaths = make(map[string]string)
+	}
+	if path == "" {
+		return t, nil
+	}
+
+	f, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if t.replay(scanner.Text()) {
+				t.records += 1
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if t.records > t.entries {
+		if err := t.compact(); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t.file = file
+	return t, nil
+}
+
+// Sets the tags of the remote path, replacing any it previously had
+func (t *TagIndex) Set(remotePath string, tags []string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	existing := t.paths[remotePath]
+	if len(existing) == len(tags) {
+		same := true
+		for _, tag := range tags {
+			if _, exists := existing[tag]; !exists {
+				same = false
+				break
+			}
+		}
+		if same {
+			return nil
+		}
+	}
+
+	var lines []byte
+	if existing != nil {
+		t.removePath(remotePath)
+		lines = appendTagLine(lines, "", remotePath)
+	}
+	for _, tag := range tags {
+		if t.add(tag, remotePath) {
+			lines = appendTagLine(lines, tag, remotePath)
+		}
+	}
+	return t.write(lines)
+}
+
+// Returns the remote paths associated with the tag
+func (t *TagIndex) Get(tag string) []string {
+	t.Lock()
+	defer t.Unlock()
+	paths := t.tags[tag]
+	remotePaths := make([]string, 0, len(paths))
+	for remotePath := range paths {
+		remotePaths = append(remotePaths, remotePath)
+	}
+	return remotePaths
+}
+
+// Removes the tag from the index
+func (t *TagIndex) Remove(tag string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if !t.removeTag(tag) {
+		return nil
+	}
+	return t.write(append([]byte(tag), '\t', '\n'))
+}
+
+// Removes the remote path from every tag
+func (t *TagIndex) RemovePath(remotePath string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if !t.removePath(remotePath) {
+		return nil
+	}
+	return t.write(appendTagLine(nil, "", remotePath))
+}
+
+// Removes the remote path whose main cache entry is metaPath (if any) from
+// every tag
+func (t *TagIndex) RemoveMeta(metaPath string) error {
+	t.Lock()
+	remotePath, exists := t.metaPaths[metaPath]
+	t.Unlock()
+	if !exists {
+		return nil
+	}
+	return t.RemovePath(remotePath)
+}
+
+// Applies a record of the log, returns false if the line isn't a record
+func (t *TagIndex) replay(line string) bool {
+	tag, remotePath, ok := parseTagLine(line)
+	if !ok {
+		return false
+	}
+	switch {
+	case tag == "":
+		t.removePath(remotePath)
+	case remotePath == "":
+		t.removeTag(tag)
+	default:
+		t.add(tag, remotePath)
+	}
+	return true
+}
+
+// Must be called under lock. Returns false if the path already had the tag.
+func (t *TagIndex) add(tag string, remotePath string) bool {
+	paths := t.tags[tag]
+	if paths == nil {
+		paths = make(map[string]struct{})
+		t.tags[tag] = paths
+	} else if _, exists := paths[remotePath]; exists {
+		return false
+	}
+	paths[remotePath] = struct{}{}
+
+	tags := t.paths[remotePath]
+	if tags == nil {
+		tags = make(map[string]struct{})
+		t.paths[remotePath] = tags
+		if t.metaPaths != nil {
+			t.metaPaths[t.metaPath(remotePath)] = remotePath
+		}
+	}
+	tags[tag] = struct{}{}
+	t.entries += 1
+	return true
+}
+
+// Must be called under lock
+func (t *TagIndex) removePath(remotePath string) bool {
+	tags, exists := t.paths[remotePath]
+	if !exists {
+		return false
+	}
+	for tag := range tags {
+		paths := t.tags[tag]
+		delete(paths, remotePath)
+		if len(paths) == 0 {
+			delete(t.tags, tag)
+		}
+	}
+	t.forgetPath(remotePath)
+	t.entries -= len(tags)
+	return true
+}
+
+// Must be called under lock
+func (t *TagIndex) removeTag(tag string) bool {
+	paths, exists := t.tags[tag]
+	if !exists {
+		return false
+	}
+	for remotePath := range paths {
+		tags := t.paths[remotePath]
+		delete(tags, tag)
+		if len(tags) == 0 {
+			t.forgetPath(remotePath)
+		}
+	}
+	delete(t.tags, tag)
+	t.entries -= len(paths)
+	return true
+}
+
+// Must be called under lock
+func (t *TagIndex) forgetPath(remotePath string) {
+	delete(t.paths, remotePath)
+	if t.metaPaths != nil {
+		delete(t.metaPaths, t.metaPath(remotePath))
+	}
+}
+
+// Must be called under lock. Appends the records to the log (if we have one),
+// compacting it if it's now too large.
+func (t *TagIndex) write(lines []byte) error {
+	if len(lines) == 0 || t.file == nil {
+		return nil
+	}
+	if _, err := t.file.Write(lines); err != nil {
+		return err
+	}
+	t.records += strings.Count(string(lines), "\n")
+	if t.records > t.entries*2+TAG_INDEX_COMPACT_MIN {
+		return t.compact()
+	}
+	return nil
+}
+
+// Must be called under lock (or before the index is shared). Rewrites the
+// log with one record per entry.
+func (t *TagIndex) compact() error {
+	var lines []byte
+	for tag, paths := range t.tags {
+		for remotePath := range paths {
+			lines = appendTagLine(lines, tag, remotePath)
+		}
+	}
+
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, lines, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(t.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.file = file
+	t.records = t.entries
+	return nil
+}
+
+func appendTagLine(lines []byte, tag string, remotePath string) []byte {
+	lines = append(lines, tag...)
+	lines = append(lines, '\t')
+	lines = strconv.AppendQuote(lines, remotePath)
+	return append(lines, '\n')
+}
+
+// A line with neither a tag nor a path isn't valid
+func parseTagLine(line string) (string, string, bool) {
+	tag, quoted, found := strings.Cut(line, "\t")
+	if !found {
+		return "", "", false
+	}
+	if quoted == "" {
+		return tag, "", tag != ""
+	}
+	remotePath, err := strconv.Unquote(quoted)
+	if err != nil || remotePath == "" {
+		return "", "", false
+	}
+	return tag, remotePath, true
+}
+
+// Surrogate-Key is space separated, Cache-Tag is comma separated. Tags with
+// control characters (tabs, newlines, ...) are ignored, they'd corrupt our
+// index.
+func parseTags(surrogateKey string, cacheTag string) []string {
+	if surrogateKey == "" && cacheTag == "" {
+		return nil
+	}
+
+	var tags []string
+	for _, tag := range strings.Fields(surrogateKey) {
+		if validTag(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	for _, tag := range strings.Split(cacheTag, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" && validTag(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func validTag(tag string) bool {
+	for i := 0; i < len(tag); i++ {
+		if c := tag[i]; c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package assets
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_ParseTags(t *testing.T) {
+	assert.Equal(t, len(parseTags("", "")), 0)
+
+	tags := parseTags(" product-1  product-2 ", "")
+	assert.Equal(t, len(tags), 2)
+	assert.Equal(t, tags[0], "product-1")
+	assert.Equal(t, tags[1], "product-2")
+
+	tags = parseTags("a", "b, c,,")
+	assert.Equal(t, len(tags), 3)
+	assert.Equal(t, tags[0], "a")
+	assert.Equal(t, tags[1], "b")
+	assert.Equal(t, tags[2], "c")
+}
+
+func Test_ParseTags_Invalid(t *testing.T) {
+	tags := parseTags("", "a,b\tc, d\ne,f")
+	assert.Equal(t, len(tags), 2)
+	assert.Equal(t, tags[0], "a")
+	assert.Equal(t, tags[1], "f")
+}
+
+func Test_TagIndex_SetGetRemove(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "tags.idx")
+	idx, err := NewTagIndex(p, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(idx.Get("t1")), 0)
+
+	assert.Nil(t, idx.Set("a.css", []string{"t1", "t2"}))
+	assert.Nil(t, idx.Set("b\n.css", []string{"t1"}))
+
+	paths := idx.Get("t1")
+	sort.Strings(paths)
+	assert.Equal(t, len(paths), 2)
+	assert.Equal(t, paths[0], "a.css")
+	assert.Equal(t, paths[1], "b\n.css")
+
+	// persisted
+	idx, err = NewTagIndex(p, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(idx.Get("t1")), 2)
+	assert.Equal(t, len(idx.Get("t2")), 1)
+
+	assert.Nil(t, idx.Remove("t1"))
+	assert.Equal(t, len(idx.Get("t1")), 0)
+	assert.Nil(t, idx.Set("c.css", []string{"t2"}))
+
+	// compacted, and still appendable
+	idx, err = NewTagIndex(p, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(idx.Get("t1")), 0)
+	assert.Equal(t, len(idx.Get("t2")), 2)
+	assert.Equal(t, countLines(p), 2)
+}
+
+func Test_TagIndex_InMemory(t *testing.T) {
+	idx, err := NewTagIndex("", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, idx.Set("a.css", []string{"t1"}))
+	assert.Nil(t, idx.Set("b.css", []string{"t1"}))
+	assert.Nil(t, idx.RemovePath("a.css"))
+
+	paths := idx.Get("t1")
+	assert.Equal(t, len(paths), 1)
+	assert.Equal(t, paths[0], "b.css")
+}
+
+func Test_TagIndex_SetReplaces(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "tags.idx")
+	idx, _ := NewTagIndex(p, nil)
+
+	assert.Nil(t, idx.Set("a.css", []string{"t1", "t2"}))
+	// re-saving with the same tags doesn't grow the log
+	assert.Nil(t, idx.Set("a.css", []string{"t2", "t1"}))
+	assert.Equal(t, countLines(p), 2)
+
+	assert.Nil(t, idx.Set("a.css", []string{"t3"}))
+	assert.Equal(t, len(idx.Get("t1")), 0)
+	assert.Equal(t, len(idx.Get("t3")), 1)
+
+	assert.Nil(t, idx.Set("a.css", nil))
+	assert.Equal(t, len(idx.Get("t3")), 0)
+
+	idx, _ = NewTagIndex(p, nil)
+	assert.Equal(t, len(idx.Get("t3")), 0)
+	assert.Equal(t, countLines(p), 0)
+}
+
+func Test_TagIndex_RemovePath(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "tags.idx")
+	idx, _ := NewTagIndex(p, func(remotePath string) string {
+		return remotePath + ".res"
+	})
+
+	assert.Nil(t, idx.Set("a.css", []string{"t1"}))
+	assert.Nil(t, idx.Set("b.css", []string{"t1", "t2"}))
+	assert.Nil(t, idx.RemovePath("a.css"))
+	assert.Equal(t, len(idx.Get("t1")), 1)
+
+	// not the main entry of anything we know about
+	assert.Nil(t, idx.RemoveMeta("b_thumb.css.res"))
+	assert.Equal(t, len(idx.Get("t2")), 1)
+
+	assert.Nil(t, idx.RemoveMeta("b.css.res"))
+	assert.Equal(t, len(idx.Get("t1")), 0)
+	assert.Equal(t, len(idx.Get("t2")), 0)
+
+	idx, _ = NewTagIndex(p, nil)
+	assert.Equal(t, len(idx.Get("t1")), 0)
+	assert.Equal(t, len(idx.Get("t2")), 0)
+}
+
+func Test_TagIndex_CompactsWhenLarge(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "tags.idx")
+	idx, _ := NewTagIndex(p, nil)
+
+	for i := 0; i < TAG_INDEX_COMPACT_MIN; i++ {
+		assert.Nil(t, idx.Set("a.css", []string{"t1"}))
+		assert.Nil(t, idx.Set("a.css", []string{"t2"}))
+	}
+	assert.True(t, countLines(p) <= TAG_INDEX_COMPACT_MIN+2)
+	assert.Equal(t, len(idx.Get("t2")), 1)
+}
+
+func countLines(p string) int {
+	data, _ := os.ReadFile(p)
+	return strings.Count(string(data), "\n")
+}
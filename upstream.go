@@ -1,17 +1,27 @@
 package assets
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"math/rand"
+	"net"
 	gohttp "net/http"
+	"net/textproto"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -24,23 +34,66 @@ import (
 
 var (
 	errSingleflightLocalLoad = errors.New("Singleflight local load error")
+	errObjectTooLarge        = errors.New("Object exceeds max_object_size")
+	errStaleChanged          = errors.New("Cached entry changed while revalidating")
+	errStaleCorrupt          = errors.New("Cached entry is corrupt")
+	errServeStale            = errors.New("Upstream failed, serve stale")
 	resNotFound              = http.StaticError(404, RES_NOT_FOUND_CACHE, "not found")
 )
 
+const (
+	// bytes of the sha256 of the remote path that we use in the filename,
+	// 18 bytes base64 encode to exactly 24 characters
+	CACHE_KEY_LENGTH = 18
+
+	// longer extensions are dropped from the filename
+	MAX_CACHE_EXTENSION = 16
+)
+
 type Upstream struct {
 	name string
 
 	client *gohttp.Client
+	retry  RetryPolicy
+
+	// fails requests to the upstream fast when it's down (can be nil)
+	breaker *CircuitBreaker
+
+	// generic responses larger than this are streamed to the store rather
+	// than buffered in memory
+	streamThreshold int64
+
+	// responses larger than this aren't cached (0 == no limit), keyed by
+	// extension (lowercase, with the leading dot)
+	maxObjectSizeDefault int64
+	maxObjectSizes       map[string]int64
 
 	// Upstream-specific counter for generating the RequestId
 	requestId uint32
 
-	// the actual upstream server root (e.g. http://goblgobl.com/assets/)
+	// the actual upstream server root (e.g. http://goblgobl.com/assets/), the
+	// first of our hosts when there are several
 	baseURL string
+	hosts   *Hosts
+
+	// the client's query parameters that we forward (see RemotePath)
+	queryParams []string
+
+	// sent with every request to the upstream
+	requestHeaders gohttp.Header
+	requestHost    string
+	auth           Authenticator
 
 	// config.cache.root + upstream name
 	cacheRoot []byte
 
+	// where our cache files actually live
+	store Store
+
+	// name cache files by the base64 encoded remote path rather than by a hash
+	// of it (see cacheKey)
+	legacyNames bool
+
 	// thundering herd protection, limits infight upstream requests
 	// to a single request, with any concurrent request waiting and
 	// receiving the reply from the first
@@ -59,11 +112,47 @@ type Upstream struct {
 	// xform parameter -> vips command line
 	transforms map[string][]string
 
+	// canonical names of the upstream response headers to store and replay
+	headers []string
+
+	// fraction (0-1) of cache hits for which we verify the body's checksum
+	checksumSample float64
+
 	notFoundCache *NotFoundCache
+
+	// nil when max_cache_bytes isn't configured
+	diskCache *DiskCache
+
+	// nil when hot_cache_bytes isn't configured
+	hotCache *HotCache
+
+	// Surrogate-Key / Cache-Tag => remote paths
+	tagIndex *TagIndex
+
+	// how often the sweeper runs (0 == never) and how long (in seconds) an entry
+	// has to have been expired for before the sweeper deletes it
+	sweepInterval time.Duration
+	sweepGrace    uint32
+
+	// seconds an expired entry can still be served for while it's refreshed in
+	// the background (the response's own stale-while-revalidate can extend this)
+	staleWhileRevalidate uint32
+
+	// seconds an expired entry can still be served for when the upstream fails
+	// (the response's own stale-if-error can extend this)
+	staleIfError uint32
+
+	// local paths currently being refreshed in the background
+	refreshing *sync.Map
+}
+
+// config.cache_root + upstream name, with a trailing slash
+func upstreamCacheRoot(name string) string {
+	return path.Join(Config.CacheRoot, name) + "/"
 }
 
 func NewUpstream(name string, config *upstreamConfig) (*Upstream, error) {
-	cacheRoot := path.Join(Config.CacheRoot, name) + "/"
+	cacheRoot := upstreamCacheRoot(name)
 	if err := os.MkdirAll(cacheRoot, 0700); err != nil {
 		return nil, fmt.Errorf("Failed to make upstream cache root (%s) - %w", cacheRoot, err)
 	}
@@ -84,16 +173,131 @@ func NewUpstream(name string, config *upstreamConfig) (*Upstream, error) {
 		defaultTTL = 60
 	}
 
-	return &Upstream{
-		name:          name,
-		sf:            new(singleflight.Group),
-		baseURL:       config.BaseURL,
-		client:        &gohttp.Client{},
-		cacheRoot:     []byte(cacheRoot),
-		defaultTTL:    uint32(defaultTTL),
-		ttls:          ttls,
-		transforms:    config.Transforms,
-		notFoundCache: NewNotFoundCache(100_000),
+	headers := make([]string, 0, len(config.Headers))
+	for _, name := range config.Headers {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		switch name {
+		case "", "Content-Type", "Cache-Control", "Content-Length", "Transfer-Encoding", "Connection":
+			// either always stored, or something we must not replay
+		default:
+			headers = append(headers, name)
+		}
+	}
+
+	checksumSample := float64(1)
+	if config.ChecksumSample != nil {
+		checksumSample = *config.ChecksumSample
+	}
+
+	var sweepInterval time.Duration
+	var sweepGrace uint32
+	if sweep := config.Sweep; sweep != nil && sweep.Interval > 0 {
+		sweepInterval = time.Duration(sweep.Interval) * time.Second
+		if sweep.Grace > 0 {
+			sweepGrace = uint32(sweep.Grace)
+		}
+	}
+
+	var staleWhileRevalidate, staleIfError uint32
+	if swr := config.StaleWhileRevalidate; swr > 0 {
+		staleWhileRevalidate = uint32(swr)
+	}
+	if sie := config.StaleIfError; sie > 0 {
+		staleIfError = uint32(sie)
+	}
+
+	// don't sweep what we can still serve
+	if sweepGrace < staleWhileRevalidate {
+		sweepGrace = staleWhileRevalidate
+	}
+	if sweepGrace < staleIfError {
+		sweepGrace = staleIfError
+	}
+
+	requestHost := ""
+	requestHeaders := make(gohttp.Header, len(config.RequestHeaders))
+	for name, value := range config.RequestHeaders {
+		if textproto.CanonicalMIMEHeaderKey(name) == "Host" {
+			requestHost = value
+		} else {
+			requestHeaders.Set(name, value)
+		}
+	}
+
+	hostConfigs := config.BaseURLs
+	if len(hostConfigs) == 0 {
+		baseURL := config.BaseURL
+		if baseURL == "" && config.S3 != nil {
+			baseURL = s3BaseURL(config.S3)
+		}
+		hostConfigs = []upstreamHostConfig{{URL: baseURL}}
+	}
+
+	baseURLs := make([]string, len(hostConfigs))
+	for i, host := range hostConfigs {
+		baseURLs[i] = host.URL
+	}
+	files, err := newFileTransport(baseURLs)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid upstream file base_url - %w", err)
+	}
+
+	client := newHTTPClient(config.HTTP, files)
+	if s3 := config.S3; s3 != nil {
+		client.Transport = newS3Transport(s3, client.Transport)
+	}
+
+	// we can't buffer more than our buffers hold
+	streamThreshold := config.StreamThreshold
+	if max := int64(config.Buffers.Max); streamThreshold <= 0 || streamThreshold > max {
+		streamThreshold = max
+	}
+
+	maxObjectSizes := make(map[string]int64, len(config.MaxObjectSizes))
+	for extension, max := range config.MaxObjectSizes {
+		extension = lowercase(extension)
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		maxObjectSizes[extension] = max
+	}
+
+	store := NewStore(config.Store)
+	u := &Upstream{
+		name:      name,
+		sf:        new(singleflight.Group),
+		baseURL:   hostConfigs[0].URL,
+		hosts:     NewHosts(hostConfigs, config.HostFailures, config.HostCooldown),
+		client:    client,
+		retry:     NewRetryPolicy(config.Retry),
+		breaker:   NewCircuitBreaker(config.Breaker),
+		cacheRoot: []byte(cacheRoot),
+		store:     store,
+
+		queryParams:     config.QueryParams,
+		requestHeaders:  requestHeaders,
+		requestHost:     requestHost,
+		auth:            NewAuthenticator(config.Auth),
+		streamThreshold: streamThreshold,
+
+		maxObjectSizeDefault: config.MaxObjectSize,
+		maxObjectSizes:       maxObjectSizes,
+
+		legacyNames: config.CacheLayout == "base64",
+		defaultTTL:  uint32(defaultTTL),
+		ttls:        ttls,
+		transforms:  config.Transforms,
+		headers:     headers,
+
+		notFoundCache:  NewNotFoundCache(100_000),
+		checksumSample: checksumSample,
+		hotCache:       NewHotCache(config.HotCacheBytes, config.HotMaxObjectBytes),
+		sweepInterval:  sweepInterval,
+		sweepGrace:     sweepGrace,
+		refreshing:     new(sync.Map),
+
+		staleWhileRevalidate: staleWhileRevalidate,
+		staleIfError:         staleIfError,
 
 		// If we let this start at 0, then restarts are likely to produce duplicates.
 		// While we make no guarantees about the uniqueness of the requestId, there's
@@ -101,7 +305,26 @@ func NewUpstream(name string, config *upstreamConfig) (*Upstream, error) {
 		requestId: uint32(time.Now().Unix()),
 		buffers:   buffer.NewPoolFromConfig(*config.Buffers),
 		logField:  log.NewField().String("up", name).Finalize(),
-	}, nil
+	}
+
+	// needs our paths, so it's loaded once we exist
+	tagIndexPath := ""
+	if _, isFileStore := store.(FileStore); isFileStore {
+		tagIndexPath = cacheRoot + "tags.idx"
+	}
+	u.tagIndex, err = NewTagIndex(tagIndexPath, u.primaryMetaPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load upstream tag index (%s) - %w", cacheRoot, err)
+	}
+
+	// loading can evict, which has to update our tag index
+	u.diskCache = NewDiskCache(store, config.MaxCacheBytes)
+	u.diskCache.OnEvict(u.forgetTags)
+	if err := u.diskCache.Load(cacheRoot); err != nil {
+		return nil, fmt.Errorf("Failed to load upstream cache (%s) - %w", cacheRoot, err)
+	}
+
+	return u, nil
 }
 
 func (u *Upstream) NextRequestId() string {
@@ -110,7 +333,11 @@ func (u *Upstream) NextRequestId() string {
 }
 
 func (u *Upstream) LoadLocalResponse(localPath string, env *Env, force bool) http.Response {
-	f, err := os.Open(localPath)
+	if hot := u.loadHot(localPath); hot != nil {
+		return hot
+	}
+
+	f, err := u.store.Open(localPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if u.notFoundCache.Get(localPath) {
@@ -131,20 +358,39 @@ func (u *Upstream) LoadLocalResponse(localPath string, env *Env, force bool) htt
 	}
 
 	// callers can opt to ignore the expiration
-	if !force {
-		if int64(lr.meta.expires) < time.Now().Unix() {
-			lr.Close()
-			// no need to delete this file, because we expect our caller to go fetch
-			// it from the upstream and save the result, overwriting this
-			return nil
-		}
+	if !force && !u.checkExpiry(lr) {
+		// no need to delete this file, because we expect our caller to go fetch
+		// it from the upstream and save the result, overwriting this
+		return nil
+	}
+
+	if !u.verify(lr, localPath, localPath, env) {
+		// our caller will fetch it again
+		return nil
 	}
 
+	u.diskCache.Touch(localPath)
+	if lr.stale {
+		// it's about to be replaced, no point promoting it
+		return lr
+	}
+	if lr = u.promote(localPath, lr, env); lr == nil {
+		return nil
+	}
 	return lr
 }
 
 func (u *Upstream) LoadLocalImage(localMetaPath string, localImagePath string, env *Env) *LocalResponse {
-	f, err := os.Open(localMetaPath)
+	return u.loadLocalImage(localMetaPath, localImagePath, env, false)
+}
+
+// force ignores the expiration (like LoadLocalResponse)
+func (u *Upstream) loadLocalImage(localMetaPath string, localImagePath string, env *Env, force bool) *LocalResponse {
+	if hot := u.loadHot(localMetaPath); hot != nil {
+		return hot
+	}
+
+	f, err := u.store.Open(localMetaPath)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			env.Error("Upstream.LoadLocalImage.Meta").String("path", localMetaPath).Err(err).Log()
@@ -166,25 +412,238 @@ func (u *Upstream) LoadLocalImage(localMetaPath string, localImagePath string, e
 		return nil
 	}
 
+	if !force && !u.checkExpiry(lr) {
+		return nil
+	}
+
 	if lr.Type() == TYPE_GENERIC {
 		// this isn't an image, the entire response is contained here
-		return lr
+		if !u.verify(lr, localMetaPath, localMetaPath, env) {
+			return nil
+		}
+		u.diskCache.Touch(localMetaPath)
+		if lr.stale {
+			return lr
+		}
+		return u.promote(localMetaPath, lr, env)
 	}
 
 	// We have an image metadata file. We no longer need it (our lr has already
 	// parsed the header, which is all this file contains). We need to load
 	// the real image now.
 	f.Close()
-	f, err = os.Open(localImagePath)
+	f, err = u.store.Open(localImagePath)
 	if err != nil {
 		// this should not happen
 		env.Error("Upstream.LoadLocalImage.Image").String("path", localImagePath).Err(err).Log()
 		return nil
 	}
 	lr.file = f
+
+	if !u.verify(lr, localMetaPath, localImagePath, env) {
+		return nil
+	}
+	u.diskCache.Touch(localMetaPath)
+	if lr.stale {
+		return lr
+	}
+	return u.promote(localMetaPath, lr, env)
+}
+
+// Returns false (and closes lr) if lr has expired and can't be served. An
+// expired response which is still within its stale-while-revalidate window
+// is marked as stale, and it's up to our caller to refresh it (see
+// RefreshInBackground)
+func (u *Upstream) checkExpiry(lr *LocalResponse) bool {
+	meta := lr.meta
+	now := time.Now().Unix()
+	if int64(meta.expires) >= now {
+		return true
+	}
+
+	if now > int64(meta.expires)+int64(staleWindow(meta, u.staleWhileRevalidate, "stale-while-revalidate=")) {
+		lr.Close()
+		return false
+	}
+	lr.stale = true
+	return true
+}
+
+// How long, in seconds, an expired entry can be served for. This is the larger
+// of our configured value and the response's own Cache-Control directive (which
+// the sweeper also honors, see Meta.stale).
+func staleWindow(meta *Meta, configured uint32, directive string) uint32 {
+	window := configured
+	if w := cacheControlSeconds(meta.cacheControl, directive); w > window {
+		window = w
+	}
+	return window
+}
+
+func (u *Upstream) canServeStaleIfError(meta *Meta) bool {
+	if u.breaker.IsOpen() {
+		// anything is better than nothing
+		return true
+	}
+	window := staleWindow(meta, u.staleIfError, "stale-if-error=")
+	return time.Now().Unix() <= int64(meta.expires)+int64(window)
+}
+
+// When the upstream is down (or erroring) and we have a copy of the response
+// that's within its stale-if-error window, we'd rather serve that than the
+// error. res and err are the result of our request to the upstream.
+func (u *Upstream) serveStaleOnError(remotePath string, localPath string, res *gohttp.Response, err error, env *Env) bool {
+	if err == nil && res.StatusCode < 500 {
+		return false
+	}
+
+	meta, e := u.readMeta(localPath)
+	if e != nil || !u.canServeStaleIfError(meta) {
+		return false
+	}
+
+	logger := env.Warn("Upstream.staleIfError").String("remote", remotePath)
+	if err != nil {
+		logger.Err(err)
+	} else {
+		logger.Int("status", res.StatusCode)
+		res.Body.Close()
+	}
+	logger.Log()
+	return true
+}
+
+// Loads an expired response which is within its stale-if-error window.
+// Used when the upstream fails.
+func (u *Upstream) LoadStaleResponse(localPath string, env *Env) *LocalResponse {
+	lr, ok := u.LoadLocalResponse(localPath, env, true).(*LocalResponse)
+	if !ok {
+		return nil
+	}
+	return u.markStaleIfError(lr)
+}
+
+// Same as LoadStaleResponse, but for an image (or transform)
+func (u *Upstream) LoadStaleImage(localMetaPath string, localImagePath string, env *Env) *LocalResponse {
+	lr := u.loadLocalImage(localMetaPath, localImagePath, env, true)
+	if lr == nil {
+		return nil
+	}
+	return u.markStaleIfError(lr)
+}
+
+func (u *Upstream) markStaleIfError(lr *LocalResponse) *LocalResponse {
+	meta := lr.meta
+	if int64(meta.expires) >= time.Now().Unix() {
+		// someone refreshed it in the meantime
+		return lr
+	}
+	if !u.canServeStaleIfError(meta) {
+		lr.Close()
+		return nil
+	}
+	lr.stale = true
+	lr.staleIfError = true
+	return lr
+}
+
+// Runs refresh in its own goroutine (with its own env), unless a refresh for
+// the path is already running. refresh is expected to go through the normal
+// fetch flow, and thus our singleflight.
+func (u *Upstream) RefreshInBackground(localPath string, refresh func(env *Env) (http.Response, error)) {
+	if _, running := u.refreshing.LoadOrStore(localPath, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer u.refreshing.Delete(localPath)
+
+		env := NewEnv(u)
+		defer env.Release()
+
+		res, err := refresh(env)
+		if err != nil {
+			env.Error("Upstream.RefreshInBackground").String("path", localPath).Err(err).Log()
+			return
+		}
+		// nobody is going to write this
+		if closer, ok := res.(io.Closer); ok {
+			closer.Close()
+		}
+	}()
+}
+
+// Returns a response for the path from our in-memory hot tier, if we have it
+func (u *Upstream) loadHot(localPath string) *LocalResponse {
+	meta, body := u.hotCache.Get(localPath)
+	if meta == nil {
+		return nil
+	}
+
+	return &LocalResponse{
+		hit:      true,
+		hot:      true,
+		meta:     meta,
+		upstream: u,
+		file:     memoryReader{bytes.NewReader(body)},
+	}
+}
+
+// Possibly adds a response that we just loaded from our store to our hot
+// tier, in which case its body is read into memory and the response is served
+// from that. lr must be positioned at the start of its body. Returns nil (and
+// closes lr) if the body can't be read.
+func (u *Upstream) promote(localPath string, lr *LocalResponse, env *Env) *LocalResponse {
+	meta := lr.meta
+	if !u.hotCache.Admit(localPath, meta) {
+		return lr
+	}
+
+	body := make([]byte, meta.bodyLength)
+	_, err := io.ReadFull(lr.file, body)
+	lr.Close()
+	if err != nil {
+		env.Error("Upstream.promote").String("path", localPath).Err(err).Log()
+		return nil
+	}
+
+	u.hotCache.Set(localPath, meta, body)
+	lr.file = memoryReader{bytes.NewReader(body)}
 	return lr
 }
 
+// Returns false if the response's body (read from path) doesn't match its
+// checksum, in which case lr is closed and the caller should treat this as a
+// cache miss. The entry is removed, so that it isn't revalidated (which would
+// keep the corrupt body) but fetched again. Depending on the upstream's
+// checksum_sample, only some responses are verified.
+func (u *Upstream) verify(lr *LocalResponse, metaPath string, path string, env *Env) bool {
+	meta := lr.meta
+	if !meta.hasChecksum || !u.sampleChecksum() {
+		return true
+	}
+
+	if meta.checksumMatches(lr.file) {
+		return true
+	}
+
+	lr.Close()
+	env.Warn("Upstream.checksum").String("path", path).Log()
+
+	u.hotCache.Delete(metaPath)
+	if _, err := removeCacheFiles(u.store, metaPath); err != nil {
+		env.Error("Upstream.checksum.remove").String("path", metaPath).Err(err).Log()
+		return false
+	}
+	u.diskCache.Remove(metaPath)
+	return false
+}
+
+func (u *Upstream) sampleChecksum() bool {
+	sample := u.checksumSample
+	return sample >= 1 || (sample > 0 && rand.Float64() < sample)
+}
+
 // Our caller wants to check if we have an origin image locally cached.
 // We might have it, in which case we'll return exists == true to let it know
 // the file exists. But we might have a non-image locally cached instead. This
@@ -193,7 +652,7 @@ func (u *Upstream) LoadLocalImage(localMetaPath string, localImagePath string, e
 // returna  LocalResponse so that the cached response can be sent to the client
 // as-is, without any additional image processing.
 func (u *Upstream) OriginImageCheck(localMetaPath string, env *Env) (http.Response, uint32, error) {
-	f, err := os.Open(localMetaPath)
+	f, err := u.store.Open(localMetaPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if u.notFoundCache.Get(localMetaPath) {
@@ -204,8 +663,8 @@ func (u *Upstream) OriginImageCheck(localMetaPath string, env *Env) (http.Respon
 		return nil, 0, err
 	}
 
-	// lr owns f
-	lr, err := NewLocalResponse(u, f, false)
+	// lr owns f (we need the headers for the checksum)
+	lr, err := NewLocalResponse(u, f, true)
 	if err != nil {
 		// this should not happen, let's pretend the file simply doesn't exist
 		env.Error("Upstream.OriginImageCheck").Err(err).String("path", localMetaPath).Log()
@@ -225,19 +684,42 @@ func (u *Upstream) OriginImageCheck(localMetaPath string, env *Env) (http.Respon
 		return lr, 0, nil
 	}
 
-	// We appear to have a valid origin image, there isn't anything we need from
-	// it at this point
+	// We appear to have a valid origin image, there isn't anything else we
+	// need from the meta at this point
 	lr.Close()
 
+	// A corrupt origin would break every transform, so treat it as missing
+	if lr.meta.hasChecksum && u.sampleChecksum() {
+		localImagePath := localMetaPath[:len(localMetaPath)-4]
+		f, err := u.store.Open(localImagePath)
+		if err != nil {
+			env.Error("Upstream.OriginImageCheck.Image").String("path", localImagePath).Err(err).Log()
+			return nil, 0, nil
+		}
+		lr.file = f
+		if !u.verify(lr, localMetaPath, localImagePath, env) {
+			return nil, 0, nil
+		}
+		lr.Close()
+	}
+
+	u.diskCache.Touch(localMetaPath)
+
 	return nil, expires, nil
 }
 
 func (u *Upstream) LocalResPath(remotePath string, extension string) string {
 	root := u.cacheRoot
+	if !u.legacyNames && len(extension) > MAX_CACHE_EXTENSION {
+		// the extension is only there to make the cache easier to browse, with
+		// the hash layout, the filename length must not depend on the remote path
+		extension = ""
+	}
 
 	// +3 for the subfolder that we'll use, which will be encodedPath[:2] + "/"
+	key := u.cacheKey(remotePath)
 	prefixLength := len(root) + 3
-	encodedLength := base64.RawURLEncoding.EncodedLen(len(remotePath))
+	encodedLength := base64.RawURLEncoding.EncodedLen(len(key))
 	filnameLength := prefixLength + encodedLength
 	fullLength := filnameLength + len(extension)
 
@@ -245,7 +727,7 @@ func (u *Upstream) LocalResPath(remotePath string, extension string) string {
 	dst := make([]byte, fullLength+4)
 	copy(dst, root)
 
-	base64.RawURLEncoding.Encode(dst[prefixLength:], utils.S2B(remotePath))
+	base64.RawURLEncoding.Encode(dst[prefixLength:], key)
 
 	// At this point, we have something like:
 	//   {r, o, o, t, /, 0, 0, 0, e, n, c, o, d, e, d}
@@ -264,6 +746,49 @@ func (u *Upstream) LocalResPath(remotePath string, extension string) string {
 	return utils.B2S(dst)
 }
 
+// The path that we request from the upstream and cache by: the path plus
+// whichever of the query's parameters we forward, sorted by name, so that
+// ?b=2&a=1 and ?a=1&b=2&utm=x share a cache entry.
+func (u *Upstream) RemotePath(requestPath string, rawQuery string) string {
+	if len(u.queryParams) == 0 || rawQuery == "" {
+		return requestPath
+	}
+
+	// on error, query has whatever could be parsed
+	query, _ := url.ParseQuery(rawQuery)
+
+	forwarded := make(url.Values, len(u.queryParams))
+	for _, name := range u.queryParams {
+		if values, exists := query[name]; exists {
+			forwarded[name] = values
+		}
+	}
+	if len(forwarded) == 0 {
+		return requestPath
+	}
+	return requestPath + "?" + forwarded.Encode()
+}
+
+// The lowercase extension of the remote path, ignoring any query
+func remoteExtension(remotePath string) string {
+	if i := strings.IndexByte(remotePath, '?'); i != -1 {
+		remotePath = remotePath[:i]
+	}
+	return lowercase(filepath.Ext(remotePath))
+}
+
+// What we encode into the filename. Originally, this was the remote path
+// itself, but filenames are limited to 255 bytes, so long paths couldn't be
+// cached. Now it's a fixed-length hash of the remote path (the path itself is
+// stored in the meta).
+func (u *Upstream) cacheKey(remotePath string) []byte {
+	if u.legacyNames {
+		return utils.S2B(remotePath)
+	}
+	sum := sha256.Sum256(utils.S2B(remotePath))
+	return sum[:CACHE_KEY_LENGTH]
+}
+
 // originPath: up-name/AZ/AZ123.jpg.res
 // metaPath: up-name/AZ/AZ123_xform.jpg.res
 // imagePath: up-name/AZ/AZ123_xform.jpg
@@ -276,8 +801,9 @@ func (u *Upstream) LocalImagePath(remotePath string, extension string, xform []b
 	if xformLength > 0 {
 		xformLength += 1
 	}
+	key := u.cacheKey(remotePath)
 	prefixLength := len(root) + 3
-	encodedLength := base64.RawURLEncoding.EncodedLen(len(remotePath))
+	encodedLength := base64.RawURLEncoding.EncodedLen(len(key))
 	filnameLength := prefixLength + encodedLength
 	fullLength := filnameLength + xformLength + len(extension)
 
@@ -285,7 +811,7 @@ func (u *Upstream) LocalImagePath(remotePath string, extension string, xform []b
 	dst := make([]byte, fullLength+4)
 	copy(dst, root)
 
-	base64.RawURLEncoding.Encode(dst[prefixLength:], utils.S2B(remotePath))
+	base64.RawURLEncoding.Encode(dst[prefixLength:], key)
 
 	// At this point, we have something like:
 	//   {r, o, o, t, /, 0, 0, 0, e, n, c, o, d, e, d}
@@ -310,6 +836,109 @@ func (u *Upstream) LocalImagePath(remotePath string, extension string, xform []b
 	return metaPath, metaPath[:fullLength]
 }
 
+// Removes every cached file for the remote path. For images, this is the
+// origin and all of its transforms. A path without a query also removes all
+// of its query variants (see RemotePath). Returns the cache entries (.res
+// files) that were removed.
+func (u *Upstream) Purge(remotePath string) ([]string, error) {
+	removed := []string{}
+	if !strings.Contains(remotePath, "?") {
+		for _, variant := range u.tagIndex.Get(queryVariantsTag(remotePath)) {
+			r, err := u.Purge(variant)
+			removed = append(removed, r...)
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	var metaPaths []string
+	extension := remoteExtension(remotePath)
+
+	if isImageExtension(extension) {
+		metaPath, _ := u.LocalImagePath(remotePath, extension, nil)
+		metaPaths = append(metaPaths, metaPath)
+		for xform := range u.transforms {
+			metaPath, _ := u.LocalImagePath(remotePath, extension, []byte(xform))
+			metaPaths = append(metaPaths, metaPath)
+		}
+	} else {
+		metaPaths = append(metaPaths, u.LocalResPath(remotePath, extension))
+	}
+
+	for _, metaPath := range metaPaths {
+		u.hotCache.Delete(metaPath)
+		u.notFoundCache.Delete(metaPath)
+		existed, err := removeCacheFiles(u.store, metaPath)
+		if err != nil {
+			return removed, log.ErrData(ERR_FS_REMOVE, err, map[string]any{"path": metaPath})
+		}
+		u.diskCache.Remove(metaPath)
+		if existed {
+			removed = append(removed, metaPath)
+		}
+	}
+
+	if err := u.tagIndex.RemovePath(remotePath); err != nil {
+		return removed, log.ErrData(ERR_TAG_INDEX, err, map[string]any{"remote": remotePath})
+	}
+	return removed, nil
+}
+
+// Purges every asset that the upstream tagged with the given tag
+func (u *Upstream) PurgeTag(tag string) ([]string, error) {
+	var removed []string
+	for _, remotePath := range u.tagIndex.Get(tag) {
+		r, err := u.Purge(remotePath)
+		removed = append(removed, r...)
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	if err := u.tagIndex.Remove(tag); err != nil {
+		return removed, log.ErrData(ERR_TAG_INDEX, err, map[string]any{"tag": tag})
+	}
+	return removed, nil
+}
+
+func (u *Upstream) indexTags(remotePath string, tags []string, env *Env) {
+	// query variants are grouped under their path, so that purging the path
+	// purges them all
+	if requestPath, _, found := strings.Cut(remotePath, "?"); found {
+		tags = append(tags[:len(tags):len(tags)], queryVariantsTag(requestPath))
+	}
+	if err := u.tagIndex.Set(remotePath, tags); err != nil {
+		env.Error("Upstream.indexTags").String("remote", remotePath).Err(err).Log()
+	}
+}
+
+// The internal tag that the query variants of requestPath are indexed under.
+// Tags from the upstream can't start with a space (or contain the control
+// characters that quoting escapes).
+func queryVariantsTag(requestPath string) string {
+	return " query:" + strconv.Quote(requestPath)
+}
+
+// Called when a cache entry is evicted or swept. If it's a remote path's
+// main entry (not a transform), the path is dropped from our tag index.
+func (u *Upstream) forgetTags(metaPath string) {
+	if err := u.tagIndex.RemoveMeta(metaPath); err != nil {
+		log.Error("Upstream.forgetTags").Field(u.logField).String("path", metaPath).Err(err).Log()
+	}
+}
+
+// The meta path of the remote path's generic response or origin image, the
+// entry that our tag index is concerned with
+func (u *Upstream) primaryMetaPath(remotePath string) string {
+	extension := remoteExtension(remotePath)
+	if isImageExtension(extension) {
+		metaPath, _ := u.LocalImagePath(remotePath, extension, nil)
+		return metaPath
+	}
+	return u.LocalResPath(remotePath, extension)
+}
+
 // Issues an http request to our upstream and saves the content locally.
 // The content is saved as our own Response object (serialized from a RemoteResponse
 // and loaded back into a LocalResponse)
@@ -318,15 +947,34 @@ func (u *Upstream) GetResponseAndSave(remotePath string, localPath string, env *
 
 	res, err, _ := u.sf.Do(remotePath, func() (any, error) {
 		owner = true
-		remoteURL := u.baseURL + remotePath
-		res, err := u.client.Get(remoteURL)
+		stale := u.staleMeta(localPath)
+		res, err := u.get(remotePath, stale, env)
+		if err == nil && stale != nil && res.StatusCode == 304 {
+			if _, err := u.refresh(localPath, res, stale, env); err == nil {
+				// our cached copy is good again (see below)
+				return nil, nil
+			}
+			// we couldn't use our cached copy after all, we need the body
+			res, err = u.get(remotePath, nil, env)
+		}
+
+		if u.serveStaleOnError(remotePath, localPath, res, err, env) {
+			return nil, errServeStale
+		}
 		if err != nil {
-			return nil, log.ErrData(ERR_PROXY, err, map[string]any{"url": remoteURL})
+			return nil, err
 		}
 
-		return u.createAndSaveRemoteResponse(res, localPath, TYPE_GENERIC, env)
+		return u.createAndSaveRemoteResponse(res, remotePath, localPath, TYPE_GENERIC, env)
 	})
 
+	if err == errServeStale {
+		if lr := u.LoadStaleResponse(localPath, env); lr != nil {
+			return lr, nil
+		}
+		return nil, errSingleflightLocalLoad
+	}
+
 	if err != nil {
 		return nil, err
 	}
@@ -338,19 +986,33 @@ func (u *Upstream) GetResponseAndSave(remotePath string, localPath string, env *
 
 	// This is the goroutine that actually executed the HTTP request to the upstream
 	// and thus we designate it as the owner of the response
-	if owner {
-		return res.(*RemoteResponse), nil
+	if rr, ok := res.(*RemoteResponse); ok && owner {
+		return rr, nil
+	}
+
+	// Too large to cache, there's nothing saved locally for the others
+	if pt, ok := res.(*PassThroughResponse); ok {
+		if owner {
+			return pt, nil
+		}
+		return u.getPassThrough(remotePath, env)
 	}
 
 	// This was one of the goroutines that was blocked on the singleflight.
 	// This cannot use the res.(*RemoteResponse) as our RemoteResponse cannot
-	// be shared across goroutines. Instead, at this point, we expect the file
-	// to be saved locally, so we can return a LocalResponse.
+	// be shared across goroutines. Or, the upstream told us that our cached
+	// copy is still valid, or the body was too large to buffer. Either way, at
+	// this point, we expect the file to be saved locally, so we can return a
+	// LocalResponse.
 	lr := u.LoadLocalResponse(localPath, env, true)
 	if lr == nil {
 		env.Error("Upstream.GetSaveAndServe.LoadLocal").String("remote", remotePath).Log()
 		return nil, errSingleflightLocalLoad
 	}
+	if l, ok := lr.(*LocalResponse); ok {
+		// not considered a cache hit since we had to go to the upstream first
+		l.hit = false
+	}
 	return lr, nil
 }
 
@@ -363,10 +1025,26 @@ func (u *Upstream) SaveOriginImage(remotePath string, localMetaPath string, loca
 
 	res, err, _ := u.sf.Do(remotePath, func() (any, error) {
 		owner = true
-		remoteURL := u.baseURL + remotePath
-		res, err := u.client.Get(remoteURL)
+		stale := u.staleMeta(localMetaPath)
+		res, err := u.get(remotePath, stale, env)
+		if err == nil && stale != nil && res.StatusCode == 304 {
+			if meta, err := u.refresh(localMetaPath, res, stale, env); err == nil {
+				if meta.tpe == TYPE_IMAGE {
+					return meta.expires, nil
+				}
+				// a cached non-image (see below)
+				return nil, nil
+			}
+			res, err = u.get(remotePath, nil, env)
+		}
+
+		// our caller decides what stale response to serve (the origin or
+		// the transform)
+		if u.serveStaleOnError(remotePath, localMetaPath, res, err, env) {
+			return nil, errServeStale
+		}
 		if err != nil {
-			return nil, log.ErrData(ERR_PROXY, err, map[string]any{"url": remoteURL})
+			return nil, err
 		}
 
 		body := res.Body
@@ -380,28 +1058,50 @@ func (u *Upstream) SaveOriginImage(remotePath string, localMetaPath string, loca
 		}
 
 		if status != 200 || !isImage(res) {
-			return u.createAndSaveRemoteResponse(res, localMetaPath, TYPE_GENERIC, env)
+			return u.createAndSaveRemoteResponse(res, remotePath, localMetaPath, TYPE_GENERIC, env)
 		}
 
-		defer body.Close()
+		maxSize := u.maxObjectSize(remotePath)
+		if maxSize > 0 && res.ContentLength > maxSize {
+			return u.passThrough(res, nil, remotePath, 0, env), nil
+		}
 
-		f, err := openForWrite(localImagePath, env)
+		f, err := u.store.Create(localImagePath)
 		if err != nil {
+			body.Close()
+			env.Error("Upstream.SaveOriginImage.Create").String("path", localImagePath).Err(err).Log()
 			return nil, err
 		}
-		defer f.Close()
 
-		bodyLength, err := io.Copy(f, body)
+		// without a Content-Length, we only find out that it's too large as
+		// we write it
+		bodyLength, checksum, err := copyBody(f, nil, body, maxSize)
 		if err != nil {
-			os.Remove(localImagePath)
+			f.Abort()
+			body.Close()
+			env.Error("Upstream.SaveOriginImage.Copy").String("remote", remotePath).Err(err).Log()
 			return nil, err
 		}
+		if maxSize > 0 && bodyLength > maxSize {
+			return u.passThroughWritten(res, f, 0, bodyLength, remotePath, env), nil
+		}
+		body.Close()
 
-		meta := MetaFromResponse(res, ttl, TYPE_IMAGE, uint32(bodyLength))
+		// The image has to be in place before the meta, since a reader who sees
+		// the meta will expect the image to exist.
+		if err := f.Commit(); err != nil {
+			env.Error("Upstream.SaveOriginImage.Commit").String("path", localImagePath).Err(err).Log()
+			return nil, err
+		}
+
+		meta := MetaFromResponse(res, ttl, TYPE_IMAGE, uint32(bodyLength), u.headers)
+		meta.setChecksum(checksum)
+		meta.remotePath = remotePath
 		if err := u.save(meta, localMetaPath, env); err != nil {
-			os.Remove(localImagePath)
+			u.store.Remove(localImagePath)
 			return nil, err
 		}
+		u.indexTags(remotePath, meta.tags, env)
 
 		return meta.expires, err
 	})
@@ -430,13 +1130,22 @@ func (u *Upstream) SaveOriginImage(remotePath string, localMetaPath string, loca
 
 	// This is the goroutine that actually executed the HTTP request to the upstream
 	// and thus we designate it as the owner of the response
-	if owner {
-		return res.(*RemoteResponse), 0, nil
+	if rr, ok := res.(*RemoteResponse); ok && owner {
+		return rr, 0, nil
+	}
+
+	if pt, ok := res.(*PassThroughResponse); ok {
+		if owner {
+			return pt, 0, nil
+		}
+		res, err := u.getPassThrough(remotePath, env)
+		return res, 0, err
 	}
 
 	// This was one of the goroutines that was blocked on the singleflight.
 	// This cannot use the res.(*RemoteResponse) as our RemoteResponse cannot
-	// be shared across goroutines. Instead, at this point, we expect the file
+	// be shared across goroutines. Or, the upstream told us that our cached
+	// non-image is still valid. Either way, at this point, we expect the file
 	// to be saved locally, so we can return a LocalResponse.
 	lr := u.LoadLocalResponse(localMetaPath, env, true)
 	if lr == nil {
@@ -446,16 +1155,29 @@ func (u *Upstream) SaveOriginImage(remotePath string, localMetaPath string, loca
 	return lr, 0, nil
 }
 
-func (u *Upstream) TransformImage(originImagePath string, localMetaPath string, localImagePath string, xformArgs []string, expires uint32, env *Env) error {
+func (u *Upstream) TransformImage(remotePath string, originImagePath string, localMetaPath string, localImagePath string, xformArgs []string, expires uint32, env *Env) error {
 	// TODO: optimize this (fewer allocs, singleflight, ...)
+	w, err := u.store.Create(localImagePath)
+	if err != nil {
+		env.Error("Upstream.TransformImage.Create").String("path", localImagePath).Err(err).Log()
+		return err
+	}
+
+	inputPath, outputPath, inPlace, cleanup, err := u.vipsPaths(originImagePath, w)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	defer cleanup()
+
 	args := make([]string, len(xformArgs)+3)
-	args[0] = originImagePath
+	args[0] = inputPath
 	args[1] = "-o"
 
 	// vipsthumbnails wants a relative path to the origin
 	// (it can take an absolute path too, but we support both absolute and
 	// relative, so better to just give it the relative path)
-	args[2] = path.Base(localImagePath)
+	args[2] = path.Base(outputPath)
 	for i := 0; i < len(xformArgs); i++ {
 		args[i+3] = xformArgs[i]
 	}
@@ -463,6 +1185,7 @@ func (u *Upstream) TransformImage(originImagePath string, localMetaPath string,
 	cmd := exec.Command(Config.VipsThumbnail, args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
+		w.Abort()
 		return fmt.Errorf("%s - %w", string(out), err)
 	}
 
@@ -482,45 +1205,157 @@ func (u *Upstream) TransformImage(originImagePath string, localMetaPath string,
 		env.Error("TransformImage.extension").String("ext", ext).Log()
 	}
 
-	fi, err := os.Stat(localImagePath)
+	size, checksum, err := fileChecksum(outputPath)
 	if err != nil {
-		os.Remove(localImagePath) // no point keeping this around if we can't figure it's size
-		return log.ErrData(ERR_FS_STAT, err, map[string]any{"path": localImagePath})
+		w.Abort() // no point keeping this around if we can't figure it's size
+		return log.ErrData(ERR_FS_STAT, err, map[string]any{"path": outputPath})
+	}
+
+	if !inPlace {
+		if err := copyFile(w, outputPath); err != nil {
+			w.Abort()
+			return err
+		}
 	}
 
-	maxAge := strconv.Itoa(int(expires) - int(time.Now().Unix()))
+	// image first, meta last (see SaveOriginImage)
+	if err := w.Commit(); err != nil {
+		env.Error("Upstream.TransformImage.Commit").String("path", localImagePath).Err(err).Log()
+		return err
+	}
 
 	meta := &Meta{
 		tpe:          TYPE_IMAGE,
 		status:       200,
 		expires:      expires,
 		contentType:  contentType,
-		bodyLength:   uint32(fi.Size()),
-		cacheControl: "public,max-age=" + maxAge, // TODO, this is an absolute value, it should be a TTL, duh
+		bodyLength:   uint32(size),
+		cacheControl: transformCacheControl(expires),
+		remotePath:   remotePath,
+	}
+	meta.setChecksum(checksum)
+
+	// Remember which version of the origin this was generated from, so that
+	// it can be kept when the origin is revalidated (see RefreshTransform)
+	if origin, err := u.readMeta(originImagePath + ".res"); err == nil {
+		meta.etag = origin.etag
+		meta.lastModified = origin.lastModified
 	}
 
 	if err := u.save(meta, localMetaPath, env); err != nil {
-		os.Remove(localImagePath) // no point keeping this around without a meta file
+		u.store.Remove(localImagePath) // no point keeping this around without a meta file
 		return err
 	}
 	return nil
 }
 
-func (u *Upstream) createAndSaveRemoteResponse(res *gohttp.Response, localPath string, tpe byte, env *Env) (http.Response, error) {
-	body := res.Body
-	defer body.Close()
+// When a transform expires, but its origin hasn't changed since the transform
+// was generated (same validators), there's no point regenerating it. Its
+// expiry is simply extended to match the origin's. Returns false when the
+// transform needs to be regenerated.
+func (u *Upstream) RefreshTransform(originMetaPath string, localMetaPath string, localImagePath string, expires uint32, env *Env) bool {
+	meta, err := u.readMeta(localMetaPath)
+	if err != nil || meta.tpe != TYPE_IMAGE || !meta.canRevalidate() {
+		return false
+	}
+
+	origin, err := u.readMeta(originMetaPath)
+	if err != nil || origin.etag != meta.etag || origin.lastModified != meta.lastModified {
+		return false
+	}
+
+	if _, err := u.store.Stat(localImagePath); err != nil {
+		return false
+	}
+
+	meta.expires = expires
+	meta.cacheControl = transformCacheControl(expires)
+	return u.save(meta, localMetaPath, env) == nil
+}
+
+// TODO, this is an absolute value, it should be a TTL, duh
+func transformCacheControl(expires uint32) string {
+	return "public,max-age=" + strconv.Itoa(int(expires)-int(time.Now().Unix()))
+}
+
+// vipsthumbnail reads and writes files on the local filesystem (and treats a
+// relative output path as relative to the input's directory). When our store
+// keeps files on the local filesystem, vipsthumbnail reads the origin in place
+// and writes directly to w's temporary file (which is in the same directory).
+// Otherwise, we give it a temporary directory with a copy of the origin, and
+// the output has to be copied into w (inPlace == false).
+func (u *Upstream) vipsPaths(originImagePath string, w StoreWriter) (string, string, bool, func(), error) {
+	fileStore, isFileStore := u.store.(FileStore)
+	named, isNamed := w.(interface{ Name() string })
+	if isFileStore && isNamed {
+		return fileStore.FilePath(originImagePath), named.Name(), true, func() {}, nil
+	}
+
+	dir, err := os.MkdirTemp("", "assets-")
+	if err != nil {
+		return "", "", false, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	ext := filepath.Ext(originImagePath)
+	inputPath := filepath.Join(dir, "origin"+ext)
+	if err := u.copyFromStore(originImagePath, inputPath); err != nil {
+		cleanup()
+		return "", "", false, nil, err
+	}
+	return inputPath, filepath.Join(dir, "output"+ext), false, cleanup, nil
+}
+
+func (u *Upstream) copyFromStore(storePath string, localPath string) error {
+	src, err := u.store.Open(storePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
 
+func (u *Upstream) createAndSaveRemoteResponse(res *gohttp.Response, remotePath string, localPath string, tpe byte, env *Env) (http.Response, error) {
+	body := res.Body
 	ttl := u.calculateTTL(res)
 
 	if res.StatusCode == 404 {
+		body.Close()
 		u.notFoundCache.Set(localPath, ttl)
 		return resNotFound, nil
 	}
 
+	maxSize := u.maxObjectSize(remotePath)
+	if maxSize > 0 && res.ContentLength > maxSize {
+		return u.passThrough(res, nil, remotePath, 0, env), nil
+	}
+
+	threshold := u.streamThreshold
+	if maxSize > 0 && maxSize < threshold {
+		threshold = maxSize
+	}
+	if res.ContentLength > threshold {
+		return u.streamAndSave(res, nil, remotePath, localPath, ttl, tpe, maxSize, env)
+	}
+
 	buf := u.buffers.Checkout()
-	_, err := io.Copy(buf, body)
+	_, err := io.CopyN(buf, body, threshold)
+	if err == nil {
+		// there's (probably) more, too much to keep in memory
+		defer buf.Release()
+		return u.streamAndSave(res, buf, remotePath, localPath, ttl, tpe, maxSize, env)
+	}
+	body.Close()
 
-	if err != nil {
+	if err != io.EOF {
 		buf.Release()
 		env.Error("Upstream.createAndSaveRemoteResponse.Copy").Err(err).Log()
 		return nil, err
@@ -532,29 +1367,537 @@ func (u *Upstream) createAndSaveRemoteResponse(res *gohttp.Response, localPath s
 		return nil, err
 	}
 
-	rr := NewRemoteResponse(res, buf, ttl, tpe)
-	u.save(rr, localPath, env)
+	rr := NewRemoteResponse(res, buf, ttl, tpe, u.headers)
+	rr.meta.remotePath = remotePath
+	if u.save(rr, localPath, env) == nil {
+		u.indexTags(remotePath, rr.meta.tags, env)
+	}
 	return rr, nil
 }
 
+// For bodies too large to buffer. The body (prefixed by whatever we already
+// read into buf, which can be nil) is written straight to the store, behind a
+// placeholder meta which is filled in once the body's length and checksum are
+// known. On success, we return nil and our caller serves the saved file as a
+// LocalResponse (we don't tee the body to the client: requests coalesced on
+// our singleflight need the file to be complete as soon as we return). If the
+// body turns out to be larger than maxSize (0 == no limit), the file is
+// abandoned and we return a PassThroughResponse instead.
+func (u *Upstream) streamAndSave(res *gohttp.Response, buf *buffer.Buffer, remotePath string, localPath string, ttl uint32, tpe byte, maxSize int64, env *Env) (http.Response, error) {
+	body := res.Body
+
+	meta := MetaFromResponse(res, ttl, tpe, 0, u.headers)
+	meta.setChecksum(0)
+	meta.remotePath = remotePath
+
+	// our meta is the same size no matter its length and checksum
+	header := new(bytes.Buffer)
+	meta.Serialize(header)
+	headerLength := header.Len()
+
+	w, err := u.store.Create(localPath)
+	if err != nil {
+		body.Close()
+		env.Error("Upstream.streamAndSave.Create").String("path", localPath).Err(err).Log()
+		return nil, err
+	}
+
+	abort := func() {
+		w.Abort()
+		body.Close()
+	}
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		abort()
+		env.Error("Upstream.streamAndSave.Header").String("path", localPath).Err(err).Log()
+		return nil, err
+	}
+
+	var prefix []byte
+	if buf != nil {
+		if prefix, err = buf.Bytes(); err != nil {
+			abort()
+			env.Error("Upstream.streamAndSave.Prefix").Err(err).Log()
+			return nil, err
+		}
+	}
+
+	bodyLength, checksum, err := copyBody(w, prefix, body, maxSize)
+	if err != nil {
+		abort()
+		env.Error("Upstream.streamAndSave.Copy").String("remote", remotePath).Err(err).Log()
+		return nil, err
+	}
+
+	if maxSize > 0 && bodyLength > maxSize {
+		return u.passThroughWritten(res, w, int64(headerLength), bodyLength, remotePath, env), nil
+	}
+	body.Close()
+
+	if bodyLength > math.MaxUint32 {
+		w.Abort()
+		err := fmt.Errorf("body too large to cache (%d bytes)", bodyLength)
+		env.Error("Upstream.streamAndSave.Length").String("remote", remotePath).Err(err).Log()
+		return nil, err
+	}
+
+	meta.bodyLength = uint32(bodyLength)
+	meta.setChecksum(checksum)
+	header.Reset()
+	meta.Serialize(header)
+	if header.Len() != headerLength {
+		w.Abort()
+		err := fmt.Errorf("meta changed size (%d != %d)", header.Len(), headerLength)
+		env.Error("Upstream.streamAndSave.Meta").String("path", localPath).Err(err).Log()
+		return nil, err
+	}
+
+	if _, err := w.WriteAt(header.Bytes(), 0); err != nil {
+		w.Abort()
+		env.Error("Upstream.streamAndSave.WriteAt").String("path", localPath).Err(err).Log()
+		return nil, err
+	}
+
+	if err := w.Commit(); err != nil {
+		env.Error("Upstream.streamAndSave.Commit").String("path", localPath).Err(err).Log()
+		return nil, err
+	}
+	u.saved(localPath, nil)
+	u.indexTags(remotePath, meta.tags, env)
+	return nil, nil
+}
+
+// Writes the body (prefixed by prefix, which can be nil) to w and returns its
+// length and checksum. With a maxSize (0 == no limit), we stop reading once
+// we've read more than maxSize bytes: the returned length is then larger than
+// maxSize and the rest of the body is left unread.
+func copyBody(w io.Writer, prefix []byte, body io.Reader, maxSize int64) (int64, uint32, error) {
+	hasher := crc32.New(CRC32C)
+	mw := io.MultiWriter(w, hasher)
+
+	length := int64(len(prefix))
+	if length > 0 {
+		if _, err := mw.Write(prefix); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var n int64
+	var err error
+	if maxSize > 0 {
+		// +1 so that we know if it's larger
+		n, err = io.CopyN(mw, body, maxSize-length+1)
+		if err == io.EOF {
+			err = nil
+		}
+	} else {
+		n, err = io.Copy(mw, body)
+	}
+	return length + n, hasher.Sum32(), err
+}
+
+// For a body we've found to be too large to cache while writing it to w:
+// the written bytes (starting at offset in w) are read back, followed by the
+// rest of the body. w is aborted once the response is closed.
+func (u *Upstream) passThroughWritten(res *gohttp.Response, w StoreWriter, offset int64, written int64, remotePath string, env *Env) *PassThroughResponse {
+	body := io.MultiReader(io.NewSectionReader(w, offset, written), res.Body)
+	pt := u.passThrough(res, body, remotePath, written, env)
+	pt.close = func() error {
+		w.Abort()
+		return res.Body.Close()
+	}
+	return pt
+}
+
+// The largest response (in bytes) that we'll cache for the path, 0 == no limit
+func (u *Upstream) maxObjectSize(remotePath string) int64 {
+	if max, exists := u.maxObjectSizes[remoteExtension(remotePath)]; exists {
+		return max
+	}
+	return u.maxObjectSizeDefault
+}
+
+// body defaults to the response's body. read is how much of the body we've
+// already read (and body replays) looking for the end of it.
+func (u *Upstream) passThrough(res *gohttp.Response, body io.Reader, remotePath string, read int64, env *Env) *PassThroughResponse {
+	if body == nil {
+		body = res.Body
+	}
+
+	// without a Content-Length, all we know is that it's at least this large
+	size := res.ContentLength
+	if size < 0 {
+		size = read
+	}
+
+	env.Info("Upstream.passThrough").
+		String("remote", remotePath).
+		Int("size", int(size)).
+		Bool("size_known", res.ContentLength >= 0).
+		Int("max", int(u.maxObjectSize(remotePath))).
+		Log()
+
+	return &PassThroughResponse{
+		meta:   MetaFromResponse(res, 0, TYPE_GENERIC, 0, u.headers),
+		body:   body,
+		length: int(res.ContentLength),
+		close:  res.Body.Close,
+	}
+}
+
+// For requests coalesced onto a pass-through: its body can only be streamed
+// to one client, so each gets its own.
+func (u *Upstream) getPassThrough(remotePath string, env *Env) (http.Response, error) {
+	res, err := u.get(remotePath, nil, env)
+	if err != nil {
+		return nil, err
+	}
+	return u.passThrough(res, nil, remotePath, 0, env), nil
+}
+
+// Fetches the remote path from the upstream, retrying (according to our
+// RetryPolicy) transient failures. Callers are in a singleflight, so the
+// upstream only sees one sequence of attempts for a given path. When we have
+// a stale copy with validators, the request is conditional, and a 304 means
+// our copy is still good.
+func (u *Upstream) get(remotePath string, stale *Meta, env *Env) (*gohttp.Response, error) {
+	header, err := u.requestHeader(stale)
+	if err != nil {
+		// the error is about reading the token, it never includes the token
+		return nil, log.Err(ERR_UPSTREAM_AUTH, err)
+	}
+
+	if !u.breaker.Allow() {
+		return nil, log.ErrData(ERR_PROXY_CIRCUIT_OPEN, errCircuitOpen, map[string]any{"url": u.baseURL + remotePath})
+	}
+
+	var remoteURL string
+	var res *gohttp.Response
+	retry := u.retry
+	start := time.Now()
+	var deadline time.Time
+	if retry.deadline > 0 {
+		deadline = start.Add(retry.deadline)
+	}
+
+	attempt := 1
+	for ; ; attempt++ {
+		res, remoteURL, err = u.fetch(remotePath, header, deadline, env)
+		if attempt >= retry.attempts || !retry.retryable(res, err) {
+			break
+		}
+
+		delay := retry.delay(attempt)
+		if retry.deadline > 0 && time.Since(start)+delay > retry.deadline {
+			break
+		}
+
+		logger := env.Warn("Upstream.get.retry").
+			String("url", remoteURL).
+			Int("attempt", attempt).
+			Int("delay_ms", int(delay.Milliseconds()))
+		if err != nil {
+			logger.Err(err)
+		} else {
+			logger.Int("status", res.StatusCode)
+			discard(res)
+		}
+		logger.Log()
+		time.Sleep(delay)
+	}
+
+	u.breaker.Record(failed(res, err))
+	return res, proxyError(remoteURL, attempt, err)
+}
+
+// A single attempt at getting remotePath. Each of our hosts is tried, in order
+// of preference, until one of them doesn't fail. Returns the URL that the
+// response (or error) came from. A non-zero deadline bounds how long we wait
+// for a response.
+func (u *Upstream) fetch(remotePath string, header gohttp.Header, deadline time.Time, env *Env) (*gohttp.Response, string, error) {
+	hosts := u.hosts.Order()
+	for i, host := range hosts {
+		remoteURL := host.url + remotePath
+		req, err := gohttp.NewRequest("GET", remoteURL, nil)
+		if err != nil {
+			return nil, remoteURL, err
+		}
+		req.Header = header.Clone()
+		if requestHost := u.requestHost; requestHost != "" {
+			req.Host = requestHost
+		}
+
+		res, err := u.do(req, deadline)
+		hostFailed := failed(res, err)
+		u.hosts.Record(host, hostFailed)
+		// past the deadline, failing over would only fail (and penalize) the next host
+		if !hostFailed || i == len(hosts)-1 || (!deadline.IsZero() && time.Now().After(deadline)) {
+			return res, remoteURL, err
+		}
+
+		logger := env.Warn("Upstream.fetch.failover").String("url", remoteURL)
+		if err != nil {
+			logger.Err(err)
+		} else {
+			logger.Int("status", res.StatusCode)
+			discard(res)
+		}
+		logger.Log()
+	}
+
+	// unreachable, we always have at least 1 host
+	return nil, "", errors.New("upstream has no hosts")
+}
+
+// Sends req, giving up once deadline passes. The deadline only covers getting
+// the response: the body is streamed to the client and into our cache after
+// we return and must not be cut off by the retry deadline (the client's own
+// timeouts still apply to it).
+func (u *Upstream) do(req *gohttp.Request, deadline time.Time) (*gohttp.Response, error) {
+	if deadline.IsZero() {
+		return u.client.Do(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(time.Until(deadline), cancel)
+	res, err := u.client.Do(req.WithContext(ctx))
+	if !timer.Stop() {
+		// the deadline passed, and canceled the request, before we could stop the
+		// timer. Even if we did get a response, its body can no longer be read.
+		if err == nil {
+			res.Body.Close()
+		}
+		return nil, errRetryDeadline
+	}
+	return res, err
+}
+
+// The headers for a request to the upstream: our configured headers, our
+// authorization and, when revalidating, the conditional headers.
+func (u *Upstream) requestHeader(stale *Meta) (gohttp.Header, error) {
+	header := u.requestHeaders.Clone()
+	if header == nil {
+		header = make(gohttp.Header)
+	}
+
+	if auth := u.auth; auth != nil {
+		authorization, err := auth.Authorization()
+		if err != nil {
+			return nil, err
+		}
+		header.Set("Authorization", authorization)
+	}
+
+	if stale != nil {
+		if etag := stale.etag; etag != "" {
+			header.Set("If-None-Match", etag)
+		}
+		if lastModified := stale.lastModified; lastModified != "" {
+			header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	return header, nil
+}
+
+// A failure, as far as retries, hosts and the circuit breaker are concerned
+func failed(res *gohttp.Response, err error) bool {
+	return err != nil || res.StatusCode >= 500
+}
+
+// Lets the connection be reused
+func discard(res *gohttp.Response) {
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+}
+
+func proxyError(remoteURL string, attempts int, err error) error {
+	if err == nil {
+		return nil
+	}
+	code := ERR_PROXY
+	if isTimeout(err) {
+		code = ERR_PROXY_TIMEOUT
+	}
+	return log.ErrData(code, err, map[string]any{"url": remoteURL, "attempts": attempts})
+}
+
+// A nil config, or zero values, gets Go's defaults (which means no timeouts);
+// configured upstreams get the defaults set by upstreamHTTPConfig.defaults.
+// files, which can be nil, serves file:// URLs.
+func newHTTPClient(config *upstreamHTTPConfig, files *fileTransport) *gohttp.Client {
+	if config == nil {
+		config = &upstreamHTTPConfig{}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   seconds(config.ConnectTimeout),
+		KeepAlive: seconds(config.KeepAlive),
+	}
+	if config.KeepAlive < 0 {
+		dialer.KeepAlive = -1
+	}
+
+	transport := &gohttp.Transport{
+		Proxy:                  gohttp.ProxyFromEnvironment,
+		DialContext:            dialer.DialContext,
+		ForceAttemptHTTP2:      true,
+		TLSHandshakeTimeout:    seconds(config.TLSHandshakeTimeout),
+		ResponseHeaderTimeout:  seconds(config.ResponseHeaderTimeout),
+		MaxIdleConns:           config.MaxIdleConns,
+		MaxIdleConnsPerHost:    config.MaxIdleConnsPerHost,
+		IdleConnTimeout:        seconds(config.IdleConnTimeout),
+		MaxResponseHeaderBytes: config.MaxResponseHeaderBytes,
+		DisableKeepAlives:      config.KeepAlive < 0,
+	}
+
+	if files != nil {
+		transport.RegisterProtocol("file", files)
+	}
+
+	return &gohttp.Client{
+		Timeout:   seconds(config.Timeout),
+		Transport: transport,
+	}
+}
+
+// negative (disabled) and 0 (unset) are both no timeout
+func seconds(s int32) time.Duration {
+	if s <= 0 {
+		return 0
+	}
+	return time.Duration(s) * time.Second
+}
+
+// The meta of an expired entry that we can revalidate with the upstream
+// rather than re-downloading it. Only successful responses are revalidated.
+func (u *Upstream) staleMeta(localPath string) *Meta {
+	meta, err := u.readMeta(localPath)
+	if err != nil || meta.status != 200 || !meta.canRevalidate() {
+		return nil
+	}
+
+	if meta.tpe == TYPE_IMAGE {
+		if _, err := u.store.Stat(localPath[:len(localPath)-4]); err != nil {
+			return nil
+		}
+	}
+	return meta
+}
+
+// The upstream responded with a 304 to our conditional request, we rewrite
+// the meta with the new expiry and keep the body we already have.
+func (u *Upstream) refresh(localPath string, res *gohttp.Response, stale *Meta, env *Env) (*Meta, error) {
+	res.Body.Close()
+
+	f, err := u.store.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// re-read it, it could have changed since we looked at it (and, for a
+	// non-image, we need to be positioned at the start of the body)
+	meta, err := MetaFromReader(u, f, true)
+	if err != nil {
+		return nil, err
+	}
+	if meta.etag != stale.etag || meta.lastModified != stale.lastModified {
+		return nil, errStaleChanged
+	}
+	if !u.bodyMatches(meta, localPath, f) {
+		// revalidating would keep the corrupt body, we need a new one
+		env.Warn("Upstream.refresh.checksum").String("path", localPath).Log()
+		return nil, errStaleCorrupt
+	}
+
+	meta.revalidated(res, u.calculateTTLFor(res, int(meta.status)))
+
+	var s Serializable = meta
+	if meta.tpe != TYPE_IMAGE {
+		s = storedResponse{meta: meta, body: f}
+	}
+	if err := u.save(s, localPath, env); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Whether the body of the entry matches its checksum (always true if it has
+// none). f is the meta file, positioned at the start of the body, which, for
+// an image, is in its own file.
+func (u *Upstream) bodyMatches(meta *Meta, metaPath string, f StoreFile) bool {
+	if !meta.hasChecksum {
+		return true
+	}
+	if meta.tpe != TYPE_IMAGE {
+		return meta.checksumMatches(f)
+	}
+
+	image, err := u.store.Open(metaPath[:len(metaPath)-4])
+	if err != nil {
+		return false
+	}
+	defer image.Close()
+	return meta.checksumMatches(image)
+}
+
+func (u *Upstream) readMeta(metaPath string) (*Meta, error) {
+	f, err := u.store.Open(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return MetaFromReader(u, f, true)
+}
+
 // We log the error here, because some cases won't care about this error
 // and might just ignore it, but we still want to know about it
 func (u *Upstream) save(s Serializable, localPath string, env *Env) error {
-	f, err := openForWrite(localPath, env)
+	f, err := u.store.Create(localPath)
 	if err != nil {
+		env.Error("Upstream.saveMeta.Create").String("path", localPath).Err(err).Log()
 		return err
 	}
 
-	defer f.Close()
 	if err := s.Serialize(f); err != nil {
+		f.Abort()
 		env.Error("Upstream.saveMeta").String("path", localPath).Err(err).Log()
 		return err
 	}
+
+	if err := f.Commit(); err != nil {
+		env.Error("Upstream.saveMeta.Commit").String("path", localPath).Err(err).Log()
+		return err
+	}
+	meta, _ := s.(*Meta)
+	u.saved(localPath, meta)
 	return nil
 }
 
+// Called once localPath has been (re)written. meta is only given when that's
+// all the file has (i.e. it isn't followed by the body).
+func (u *Upstream) saved(localPath string, meta *Meta) {
+	u.hotCache.Delete(localPath)
+
+	if u.diskCache != nil {
+		if info, err := u.store.Stat(localPath); err == nil {
+			size := info.Size
+			if meta != nil && meta.tpe == TYPE_IMAGE {
+				// the image itself lives in its own file, next to this meta
+				size += int64(meta.bodyLength)
+			}
+			u.diskCache.Add(localPath, size)
+		}
+	}
+}
+
 func (u *Upstream) calculateTTL(res *gohttp.Response) uint32 {
-	status := res.StatusCode
+	return u.calculateTTLFor(res, res.StatusCode)
+}
+
+// A 304 is cached for as long as the response it revalidated would be, so
+// the status can differ from the response's
+func (u *Upstream) calculateTTLFor(res *gohttp.Response, status int) uint32 {
 	ttl, exists := u.ttls[status]
 
 	if exists && ttl < 0 {
@@ -596,19 +1939,39 @@ func atoi(input string) uint32 {
 	return n
 }
 
-func openForWrite(local string, env *Env) (*os.File, error) {
-	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
-	f, err := os.OpenFile(local, flag, 0600)
+func copyFile(w io.Writer, localPath string) error {
+	f, err := os.Open(localPath)
 	if err != nil {
-		os.MkdirAll(path.Dir(local), 0700)
-		f, err = os.OpenFile(local, flag, 0600)
-		if err != nil {
-			env.Error("openForWrite").String("path", local).Err(err).Log()
-			return nil, err
-		}
+		return err
 	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
 
-	return f, nil
+// returns the size and CRC32C of the file
+func fileChecksum(p string) (int64, uint32, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	hasher := crc32.New(CRC32C)
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, hasher.Sum32(), nil
+}
+
+func isImageExtension(extension string) bool {
+	switch extension {
+	case ".png", ".jpg", ".gif", ".webp":
+		return true
+	default:
+		return false
+	}
 }
 
 func isImage(res *gohttp.Response) bool {
@@ -1,14 +1,21 @@
 package assets
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	gohttp "net/http"
+	"net/http/httptest"
 
 	"github.com/valyala/fasthttp"
 	"src.goblgobl.com/tests/assert"
@@ -86,6 +93,22 @@ func Test_Upstream_NextRequestId(t *testing.T) {
 
 func Test_Upstream_LocalPath(t *testing.T) {
 	u := &Upstream{cacheRoot: []byte("up1/cache/")}
+	assert.Equal(t, u.LocalResPath("hello_world", ".test"), "up1/cache/NQ/NQcsGuVGNQ4L-nqxHUncbxKe.test.res")
+	assert.Equal(t, u.LocalResPath("hello_world", ""), "up1/cache/NQ/NQcsGuVGNQ4L-nqxHUncbxKe.res")
+
+	// ridiculous extensions are dropped
+	assert.Equal(t, u.LocalResPath("hello_world", ".abcdefghijklmnopq"), "up1/cache/NQ/NQcsGuVGNQ4L-nqxHUncbxKe.res")
+}
+
+func Test_Upstream_LocalPath_Long(t *testing.T) {
+	u := &Upstream{cacheRoot: []byte("up1/cache/")}
+	remotePath := strings.Repeat("long/", 200) + "style.css"
+	localPath := u.LocalResPath(remotePath, ".css")
+	assert.Equal(t, len(localPath), len("up1/cache/")+3+24+len(".css.res"))
+}
+
+func Test_Upstream_LocalPath_Legacy(t *testing.T) {
+	u := &Upstream{cacheRoot: []byte("up1/cache/"), legacyNames: true}
 	assert.Equal(t, u.LocalResPath("hello_world", ".test"), "up1/cache/aG/aGVsbG9fd29ybGQ.test.res")
 	assert.Equal(t, u.LocalResPath("hello_world", ""), "up1/cache/aG/aGVsbG9fd29ybGQ.res")
 }
@@ -93,6 +116,13 @@ func Test_Upstream_LocalPath(t *testing.T) {
 func Test_Upstream_LocalImagePath(t *testing.T) {
 	u := &Upstream{cacheRoot: []byte("up1/cache/")}
 	metaPath, imagePath := u.LocalImagePath("hello_world2", ".jpg", []byte("thumb100"))
+	assert.Equal(t, metaPath, "up1/cache/Gv/GvNb1qsplEpSs6sgnrVd6Rs-_thumb100.jpg.res")
+	assert.Equal(t, imagePath, "up1/cache/Gv/GvNb1qsplEpSs6sgnrVd6Rs-_thumb100.jpg")
+}
+
+func Test_Upstream_LocalImagePath_Legacy(t *testing.T) {
+	u := &Upstream{cacheRoot: []byte("up1/cache/"), legacyNames: true}
+	metaPath, imagePath := u.LocalImagePath("hello_world2", ".jpg", []byte("thumb100"))
 	assert.Equal(t, metaPath, "up1/cache/aG/aGVsbG9fd29ybGQy_thumb100.jpg.res")
 	assert.Equal(t, imagePath, "up1/cache/aG/aGVsbG9fd29ybGQy_thumb100.jpg")
 }
@@ -105,6 +135,8 @@ func Test_Upstream_LoadLocalResponse(t *testing.T) {
 		Status(199).
 		ContentType("assets/sample1").
 		CacheControl("private;max-age=9").
+		Header("ETag", `"sample1"`).
+		Header("Access-Control-Allow-Origin", "*").
 		Response()
 
 	localPath := writeLocal(NewEnv(u), "sample1.css", rr)
@@ -116,6 +148,8 @@ func Test_Upstream_LoadLocalResponse(t *testing.T) {
 		ExpectStatus(199).
 		Header("Content-Type", "assets/sample1").
 		Header("Cache-Control", "private;max-age=9").
+		Header("ETag", `"sample1"`).
+		Header("Access-Control-Allow-Origin", "*").
 		Body
 	assert.Equal(t, body, "sample1 content")
 
@@ -124,6 +158,64 @@ func Test_Upstream_LoadLocalResponse(t *testing.T) {
 	assert.Nil(t, res)
 }
 
+func Test_Upstream_LoadLocalResponse_Checksum(t *testing.T) {
+	u := testUpstream2()
+	env := NewEnv(u)
+
+	rr := BuildRemoteResponse().Body("checksum content").Checksum().Response()
+	localPath := writeLocal(env, "checksum.css", rr)
+
+	res := u.LoadLocalResponse(localPath, env, false)
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Body, "checksum content")
+
+	// corrupt the last byte of the body, the entry is removed so that it's
+	// fetched again (rather than revalidated)
+	data, _ := os.ReadFile(localPath)
+	data[len(data)-1] = 'X'
+	os.WriteFile(localPath, data, 0600)
+	assert.Nil(t, u.LoadLocalResponse(localPath, env, false))
+	assert.False(t, fileExists(localPath))
+
+	// truncated
+	os.WriteFile(localPath, data[:len(data)-3], 0600)
+	assert.Nil(t, u.LoadLocalResponse(localPath, env, false))
+	assert.False(t, fileExists(localPath))
+
+	// not verified
+	os.WriteFile(localPath, data, 0600)
+	u.checksumSample = 0
+	assert.NotNil(t, u.LoadLocalResponse(localPath, env, false))
+}
+
+func Test_Upstream_LoadLocalResponse_Hot(t *testing.T) {
+	u := testUpstream2()
+	u.hotCache = NewHotCache(1000, 100)
+	env := NewEnv(u)
+
+	localPath := writeLocal(env, "hot.css", BuildRemoteResponse().Body("hot content").Checksum().Response())
+
+	// first request only marks it as seen, second one promotes it
+	for i := 0; i < 2; i++ {
+		res := u.LoadLocalResponse(localPath, env, false).(*LocalResponse)
+		assert.False(t, res.hot)
+		res.Close()
+	}
+
+	// served from memory, even though the file is gone
+	u.store.Remove(localPath)
+	res := u.LoadLocalResponse(localPath, env, false).(*LocalResponse)
+	assert.True(t, res.hot)
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Body, "hot content")
+
+	// purging removes it from the hot tier
+	u.Purge("hot.css")
+	assert.Nil(t, u.LoadLocalResponse(localPath, env, false))
+}
+
 func Test_Upstream_CalculateTTL(t *testing.T) {
 	createUpstream := func(defaultTTL uint32, ttls ...int) *Upstream {
 		lookup := make(map[int]int32, len(ttls)/2)
@@ -237,6 +329,807 @@ func Test_Upstream_SaveOriginImage_NotFound(t *testing.T) {
 	assert.StringContains(t, body, "202005")
 }
 
+func Test_Upstream_MemoryStore(t *testing.T) {
+	up, err := NewUpstream("up_memory", &upstreamConfig{
+		Store:   "memory",
+		BaseURL: "https://www.goblgobl.com/docs/",
+		Buffers: &buffer.Config{Count: 2, Min: 4096, Max: 4096},
+	})
+	assert.Nil(t, err)
+	env := NewEnv(up)
+
+	localPath := writeLocal(env, "memory.css", BuildRemoteResponse().Body("in memory").Checksum().Response())
+	assert.False(t, fileExists(localPath))
+
+	res := up.LoadLocalResponse(localPath, env, false)
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Body, "in memory")
+
+	removed, err := up.Purge("memory.css")
+	assert.Nil(t, err)
+	assert.Equal(t, len(removed), 1)
+	assert.Nil(t, up.LoadLocalResponse(localPath, env, false))
+}
+
+func Test_Upstream_Revalidate_NotModified(t *testing.T) {
+	var full, conditional int
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional += 1
+			w.Header().Set("Cache-Control", "public,max-age=120")
+			w.WriteHeader(304)
+			return
+		}
+		full += 1
+		w.Header().Set("ETag", `"v2"`)
+		w.Write([]byte("new body"))
+	}))
+	defer server.Close()
+
+	up := testHTTPUpstream("up_revalidate1", server.URL)
+	env := NewEnv(up)
+
+	localPath := writeLocal(env, "main.css", BuildRemoteResponse().
+		Body("cached body").
+		CacheControl("public,max-age=1").
+		ETag(`"v1"`).
+		Expires(-10).
+		Checksum().
+		Response())
+	assert.Nil(t, up.LoadLocalResponse(localPath, env, false))
+
+	res, err := up.GetResponseAndSave("main.css", localPath, env)
+	assert.Nil(t, err)
+	assert.Equal(t, conditional, 1)
+	assert.Equal(t, full, 0)
+
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	body := request.Res(t, conn).
+		OK().
+		Header("Cache-Control", "public,max-age=120").
+		Body
+	assert.Equal(t, body, "cached body")
+
+	// fresh again
+	lr := up.LoadLocalResponse(localPath, env, false).(*LocalResponse)
+	assert.Delta(t, lr.meta.expires, uint32(time.Now().Unix()+120), 2)
+	assert.Equal(t, lr.meta.etag, `"v1"`)
+	lr.Close()
+}
+
+func Test_Upstream_Revalidate_Corrupt(t *testing.T) {
+	var full int
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(304)
+			return
+		}
+		full += 1
+		w.Header().Set("ETag", `"v1"`)
+		if r.URL.Path == "/tea.png" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("fresh image"))
+			return
+		}
+		w.Write([]byte("fresh body"))
+	}))
+	defer server.Close()
+
+	up := testHTTPUpstream("up_revalidate_corrupt", server.URL)
+	env := NewEnv(up)
+
+	localPath := writeLocal(env, "main.css", BuildRemoteResponse().
+		Body("cached body").
+		ETag(`"v1"`).
+		Expires(-10).
+		Checksum().
+		Response())
+	corruptStoreFile(up.store, localPath)
+
+	res, err := up.GetResponseAndSave("main.css", localPath, env)
+	assert.Nil(t, err)
+	assert.Equal(t, full, 1)
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Body, "fresh body")
+	assert.NotNil(t, up.LoadLocalResponse(localPath, env, false))
+
+	metaPath, imagePath := up.LocalImagePath("tea.png", ".png", nil)
+	meta := &Meta{tpe: TYPE_IMAGE, status: 200, etag: `"v1"`, expires: uint32(time.Now().Unix() - 10), bodyLength: 11}
+	meta.setChecksum(crc32.Checksum([]byte("saved image"), CRC32C))
+	assert.Nil(t, up.save(meta, metaPath, env))
+	w, _ := up.store.Create(imagePath)
+	w.Write([]byte("saved image"))
+	w.Commit()
+	corruptStoreFile(up.store, imagePath)
+
+	_, expires, err := up.SaveOriginImage("tea.png", metaPath, imagePath, env)
+	assert.Nil(t, err)
+	assert.True(t, expires > 0)
+	assert.Equal(t, full, 2)
+	assert.Equal(t, readStoreFile(up.store, imagePath), "fresh image")
+}
+
+func Test_Upstream_Revalidate_Modified(t *testing.T) {
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		if r.Header.Get("If-None-Match") == `"v2"` {
+			w.WriteHeader(304)
+			return
+		}
+		w.Header().Set("ETag", `"v2"`)
+		w.Write([]byte("new body"))
+	}))
+	defer server.Close()
+
+	up := testHTTPUpstream("up_revalidate2", server.URL)
+	env := NewEnv(up)
+
+	localPath := writeLocal(env, "main.css", BuildRemoteResponse().
+		Body("cached body").
+		ETag(`"v1"`).
+		Expires(-10).
+		Response())
+
+	res, err := up.GetResponseAndSave("main.css", localPath, env)
+	assert.Nil(t, err)
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Body, "new body")
+
+	lr := up.LoadLocalResponse(localPath, env, false).(*LocalResponse)
+	assert.Equal(t, lr.meta.etag, `"v2"`)
+	lr.Close()
+}
+
+func Test_Upstream_RefreshTransform(t *testing.T) {
+	up := testInspectUpstream("up_refresh_transform")
+	env := NewEnv(up)
+
+	originMetaPath, _ := up.LocalImagePath("tea.png", ".png", nil)
+	metaPath, imagePath := up.LocalImagePath("tea.png", ".png", []byte("thumb_100"))
+
+	assert.Nil(t, up.save(&Meta{tpe: TYPE_IMAGE, status: 200, etag: `"v1"`}, originMetaPath, env))
+	assert.Nil(t, up.save(&Meta{tpe: TYPE_IMAGE, status: 200, etag: `"v1"`, bodyLength: 5}, metaPath, env))
+
+	// no image
+	expires := uint32(time.Now().Unix() + 100)
+	assert.False(t, up.RefreshTransform(originMetaPath, metaPath, imagePath, expires, env))
+
+	w, _ := up.store.Create(imagePath)
+	w.Write([]byte("image"))
+	assert.Nil(t, w.Commit())
+	assert.True(t, up.RefreshTransform(originMetaPath, metaPath, imagePath, expires, env))
+
+	meta, err := up.readMeta(metaPath)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.expires, expires)
+	assertPublicCache(t, meta.cacheControl, 100)
+
+	// the origin changed
+	assert.Nil(t, up.save(&Meta{tpe: TYPE_IMAGE, status: 200, etag: `"v2"`}, originMetaPath, env))
+	assert.False(t, up.RefreshTransform(originMetaPath, metaPath, imagePath, expires, env))
+}
+
+func Test_Upstream_CheckExpiry(t *testing.T) {
+	now := uint32(time.Now().Unix())
+	u := &Upstream{}
+
+	assert.True(t, u.checkExpiry(&LocalResponse{meta: &Meta{expires: now + 10}}))
+
+	lr := &LocalResponse{meta: &Meta{expires: now - 10}, file: memoryReader{bytes.NewReader(nil)}}
+	assert.False(t, u.checkExpiry(lr))
+	assert.False(t, lr.stale)
+
+	// configured window
+	u.staleWhileRevalidate = 20
+	lr = &LocalResponse{meta: &Meta{expires: now - 10}}
+	assert.True(t, u.checkExpiry(lr))
+	assert.True(t, lr.stale)
+
+	lr = &LocalResponse{meta: &Meta{expires: now - 30}, file: memoryReader{bytes.NewReader(nil)}}
+	assert.False(t, u.checkExpiry(lr))
+
+	// the response's own directive
+	lr = &LocalResponse{meta: &Meta{expires: now - 30, cacheControl: "max-age=5, stale-while-revalidate=60"}}
+	assert.True(t, u.checkExpiry(lr))
+	assert.True(t, lr.stale)
+}
+
+func Test_Upstream_StaleWhileRevalidate(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "public,max-age=60")
+		w.Write([]byte("fresh"))
+	}))
+	defer server.Close()
+
+	up := testHTTPUpstreamWith("up_swr", server.URL, func(c *upstreamConfig) { c.StaleWhileRevalidate = 30 })
+	env := NewEnv(up)
+
+	localPath := writeLocal(env, "main.css", BuildRemoteResponse().Body("stale").Expires(-10).Response())
+
+	res, err := loadStatic(env, "main.css", ".css")
+	assert.Nil(t, err)
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Body, "stale")
+
+	// refreshed in the background
+	var lr *LocalResponse
+	for i := 0; i < 100; i++ {
+		if l, ok := up.LoadLocalResponse(localPath, env, false).(*LocalResponse); ok {
+			if !l.stale {
+				lr = l
+				break
+			}
+			l.Close()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(t, lr)
+	conn = &fasthttp.RequestCtx{}
+	lr.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Body, "fresh")
+	assert.Equal(t, atomic.LoadInt32(&hits), 1)
+}
+
+func Test_Upstream_LoadLocalImage_Expired(t *testing.T) {
+	up := testHTTPUpstreamWith("up_image_expiry", "http://127.0.0.1:1", func(c *upstreamConfig) { c.StaleWhileRevalidate = 30 })
+	env := NewEnv(up)
+
+	metaPath, imagePath := up.LocalImagePath("tea.png", ".png", nil)
+	w, _ := up.store.Create(imagePath)
+	w.Write([]byte("image"))
+	assert.Nil(t, w.Commit())
+
+	now := uint32(time.Now().Unix())
+	assert.Nil(t, up.save(&Meta{tpe: TYPE_IMAGE, status: 200, bodyLength: 5, expires: now - 10}, metaPath, env))
+	lr := up.LoadLocalImage(metaPath, imagePath, env)
+	assert.True(t, lr.stale)
+	lr.Close()
+
+	assert.Nil(t, up.save(&Meta{tpe: TYPE_IMAGE, status: 200, bodyLength: 5, expires: now - 60}, metaPath, env))
+	assert.Nil(t, up.LoadLocalImage(metaPath, imagePath, env))
+}
+
+func Test_Upstream_StaleIfError_ServerError(t *testing.T) {
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.WriteHeader(503)
+		w.Write([]byte("down"))
+	}))
+	defer server.Close()
+
+	up := testHTTPUpstreamWith("up_sie1", server.URL, func(c *upstreamConfig) { c.StaleIfError = 60 })
+	env := NewEnv(up)
+	localPath := writeLocal(env, "main.css", BuildRemoteResponse().Body("stale").Expires(-10).Response())
+
+	res, err := up.GetResponseAndSave("main.css", localPath, env)
+	assert.Nil(t, err)
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	body := request.Res(t, conn).
+		OK().
+		Header("X-Cache", "STALE").
+		Header("Warning", `111 - "Revalidation Failed"`).
+		Body
+	assert.Equal(t, body, "stale")
+
+	// our good copy wasn't replaced by the 503
+	lr := up.LoadLocalResponse(localPath, env, true).(*LocalResponse)
+	assert.Equal(t, lr.meta.status, 200)
+	lr.Close()
+}
+
+func Test_Upstream_StaleIfError_Unreachable(t *testing.T) {
+	up := testHTTPUpstreamWith("up_sie2", "http://127.0.0.1:1", func(c *upstreamConfig) { c.StaleIfError = 60 })
+	env := NewEnv(up)
+
+	// beyond the window
+	localPath := writeLocal(env, "old.css", BuildRemoteResponse().Body("old").Expires(-100).Response())
+	_, err := up.GetResponseAndSave("old.css", localPath, env)
+	assert.NotNil(t, err)
+
+	// the response's own stale-if-error extends our window
+	localPath = writeLocal(env, "cc.css", BuildRemoteResponse().
+		Body("cc").
+		CacheControl("public,max-age=1,stale-if-error=300").
+		Expires(-100).
+		Response())
+	res, err := up.GetResponseAndSave("cc.css", localPath, env)
+	assert.Nil(t, err)
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Header("X-Cache", "STALE").Body, "cc")
+}
+
+func Test_Upstream_StaleIfError_Disabled(t *testing.T) {
+	up := testHTTPUpstream("up_sie3", "http://127.0.0.1:1")
+	env := NewEnv(up)
+
+	localPath := writeLocal(env, "main.css", BuildRemoteResponse().Body("stale").Expires(-10).Response())
+	_, err := up.GetResponseAndSave("main.css", localPath, env)
+	assert.NotNil(t, err)
+}
+
+func Test_Upstream_HTTPClient(t *testing.T) {
+	client := newHTTPClient(&upstreamHTTPConfig{
+		ConnectTimeout:         2,
+		ResponseHeaderTimeout:  -1,
+		Timeout:                10,
+		MaxIdleConnsPerHost:    4,
+		KeepAlive:              -1,
+		MaxResponseHeaderBytes: 1024,
+	}, nil)
+	assert.Equal(t, client.Timeout, 10*time.Second)
+
+	transport := client.Transport.(*gohttp.Transport)
+	assert.Equal(t, transport.ResponseHeaderTimeout, 0)
+	assert.Equal(t, transport.MaxIdleConnsPerHost, 4)
+	assert.Equal(t, transport.MaxResponseHeaderBytes, 1024)
+	assert.True(t, transport.DisableKeepAlives)
+}
+
+func Test_Upstream_Get_Timeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	up := testHTTPUpstream("up_timeout", server.URL)
+	up.client = newHTTPClient(&upstreamHTTPConfig{ResponseHeaderTimeout: 1}, nil)
+
+	_, err := up.get("slow.css", nil, NewEnv(up))
+	assert.True(t, strings.HasPrefix(err.Error(), "code: 203017 - "))
+}
+
+func Test_Upstream_Get_Retry(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(503)
+			return
+		}
+		w.Write([]byte("finally"))
+	}))
+	defer server.Close()
+
+	up := testHTTPUpstream("up_retry1", server.URL)
+	up.retry = NewRetryPolicy(&upstreamRetryConfig{Attempts: 3, Statuses: []int{503}, BackoffMS: 1})
+	env := NewEnv(up)
+
+	res, err := up.GetResponseAndSave("main.css", up.LocalResPath("main.css", ".css"), env)
+	assert.Nil(t, err)
+	assert.Equal(t, atomic.LoadInt32(&hits), 3)
+
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Body, "finally")
+}
+
+func Test_Upstream_Get_Retry_GivesUp(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	up := testHTTPUpstream("up_retry2", server.URL)
+	env := NewEnv(up)
+
+	// exhausts its attempts
+	up.retry = NewRetryPolicy(&upstreamRetryConfig{Attempts: 2, Statuses: []int{503}, BackoffMS: 1})
+	res, err := up.get("main.css", nil, env)
+	assert.Nil(t, err)
+	assert.Equal(t, res.StatusCode, 503)
+	res.Body.Close()
+	assert.Equal(t, atomic.LoadInt32(&hits), 2)
+
+	// the next delay would go past the deadline
+	atomic.StoreInt32(&hits, 0)
+	up.retry = NewRetryPolicy(&upstreamRetryConfig{Attempts: 5, Statuses: []int{503}, BackoffMS: 1000, DeadlineMS: 500})
+	res, err = up.get("main.css", nil, env)
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, atomic.LoadInt32(&hits), 1)
+}
+
+func Test_Upstream_Get_Retry_Deadline(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	up := testHTTPUpstream("up_retry4", server.URL)
+	up.retry = NewRetryPolicy(&upstreamRetryConfig{Attempts: 2, Errors: []string{RETRY_TIMEOUT}, BackoffMS: 1, DeadlineMS: 100})
+
+	// the attempt is cut off at the deadline, rather than running until the
+	// client's own timeout
+	start := time.Now()
+	_, err := up.get("slow.css", nil, NewEnv(up))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.True(t, strings.HasPrefix(err.Error(), "code: 203017 - "))
+}
+
+func Test_Upstream_Get_Retry_Network(t *testing.T) {
+	up := testHTTPUpstream("up_retry3", "http://127.0.0.1:1")
+	up.retry = NewRetryPolicy(&upstreamRetryConfig{Attempts: 2, Errors: []string{RETRY_NETWORK}, BackoffMS: 1})
+
+	_, err := up.get("main.css", nil, NewEnv(up))
+	assert.True(t, strings.HasPrefix(err.Error(), "code: 203007 - "))
+}
+
+func Test_Upstream_CircuitBreaker(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	up := testHTTPUpstream("up_breaker", server.URL)
+	up.breaker = NewCircuitBreaker(&upstreamBreakerConfig{Failures: 2})
+	env := NewEnv(up)
+
+	for i := 0; i < 2; i++ {
+		res, err := up.get("main.css", nil, env)
+		assert.Nil(t, err)
+		res.Body.Close()
+	}
+	assert.True(t, up.breaker.IsOpen())
+
+	// fails fast
+	_, err := up.get("main.css", nil, env)
+	assert.True(t, strings.HasPrefix(err.Error(), "code: 203019 - "))
+	assert.Equal(t, atomic.LoadInt32(&hits), 2)
+
+	// while open, any expired copy is served (we have no stale_if_error)
+	localPath := writeLocal(env, "old.css", BuildRemoteResponse().Body("old").Expires(-3600).Response())
+	res, err := up.GetResponseAndSave("old.css", localPath, env)
+	assert.Nil(t, err)
+	conn := &fasthttp.RequestCtx{}
+	res.Write(conn, log.Noop{})
+	assert.Equal(t, request.Res(t, conn).OK().Header("X-Cache", "STALE").Body, "old")
+	assert.Equal(t, atomic.LoadInt32(&hits), 2)
+}
+
+func Test_Upstream_Failover(t *testing.T) {
+	var downHits, upHits int32
+	down := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		atomic.AddInt32(&downHits, 1)
+		w.WriteHeader(502)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		atomic.AddInt32(&upHits, 1)
+		w.Write([]byte("from " + r.URL.Path))
+	}))
+	defer up.Close()
+
+	u, err := NewUpstream("up_failover", &upstreamConfig{
+		Store:        "memory",
+		Buffers:      &buffer.Config{Count: 2, Min: 4096, Max: 4096},
+		HostFailures: 1,
+		BaseURLs: []upstreamHostConfig{
+			{URL: down.URL + "/x/"},
+			{URL: up.URL + "/y/"},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, u.baseURL, down.URL+"/x/")
+	env := NewEnv(u)
+
+	for i := 0; i < 3; i++ {
+		res, err := u.GetResponseAndSave("main.css", u.LocalResPath("main.css", ".css"), env)
+		assert.Nil(t, err)
+		conn := &fasthttp.RequestCtx{}
+		res.Write(conn, log.Noop{})
+		assert.Equal(t, request.Res(t, conn).OK().Body, "from /y/main.css")
+	}
+	assert.Equal(t, atomic.LoadInt32(&upHits), 3)
+	// marked as down after its first failure
+	assert.Equal(t, atomic.LoadInt32(&downHits), 1)
+}
+
+func Test_Upstream_RequestHeaders(t *testing.T) {
+	var received *gohttp.Request
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		received = r
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	up, err := NewUpstream("up_headers", &upstreamConfig{
+		Store:   "memory",
+		BaseURL: server.URL + "/",
+		Buffers: &buffer.Config{Count: 2, Min: 4096, Max: 4096},
+		RequestHeaders: map[string]string{
+			"host":       "assets.goblgobl.com",
+			"X-Api-Key":  "key1",
+			"User-Agent": "goblgobl-assets",
+		},
+		Auth: &upstreamAuthConfig{Type: AUTH_BEARER, Token: "secret"},
+	})
+	assert.Nil(t, err)
+
+	res, err := up.get("main.css", &Meta{etag: `"e1"`}, NewEnv(up))
+	assert.Nil(t, err)
+	res.Body.Close()
+
+	assert.Equal(t, received.Host, "assets.goblgobl.com")
+	assert.Equal(t, received.Header.Get("X-Api-Key"), "key1")
+	assert.Equal(t, received.Header.Get("User-Agent"), "goblgobl-assets")
+	assert.Equal(t, received.Header.Get("Authorization"), "Bearer secret")
+	assert.Equal(t, received.Header.Get("If-None-Match"), `"e1"`)
+
+	// our configured headers weren't touched
+	assert.Equal(t, len(up.requestHeaders), 2)
+}
+
+func Test_Upstream_RequestHeaders_AuthError(t *testing.T) {
+	up := testHTTPUpstream("up_auth_error", "http://127.0.0.1:1")
+	up.auth = NewAuthenticator(&upstreamAuthConfig{Type: AUTH_BEARER_FILE, TokenFile: "/invalid/token"})
+
+	_, err := up.get("main.css", nil, NewEnv(up))
+	assert.True(t, strings.HasPrefix(err.Error(), "code: 203021 - "))
+}
+
+func Test_Upstream_StreamLargeBody(t *testing.T) {
+	large := strings.Repeat("0123456789", 1000)
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		switch r.URL.Path {
+		case "/small.js":
+			w.Write([]byte("small"))
+		case "/chunked.js":
+			// no Content-Length, we only find out it's large while reading it
+			w.(gohttp.Flusher).Flush()
+			w.Write([]byte(large))
+		default:
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+			w.Write([]byte(large))
+		}
+	}))
+	defer server.Close()
+
+	// our buffers are 4096 bytes
+	up := testDiskHTTPUpstream("up_stream", server.URL)
+	env := NewEnv(up)
+
+	res, err := up.GetResponseAndSave("small.js", up.LocalResPath("small.js", ".js"), env)
+	assert.Nil(t, err)
+	rr, buffered := res.(*RemoteResponse)
+	assert.True(t, buffered)
+	rr.Close()
+
+	for _, remotePath := range []string{"large.js", "chunked.js"} {
+		localPath := up.LocalResPath(remotePath, ".js")
+		res, err := up.GetResponseAndSave(remotePath, localPath, env)
+		assert.Nil(t, err)
+		lr := res.(*LocalResponse)
+		assert.False(t, lr.hit)
+		assert.Equal(t, lr.meta.bodyLength, uint32(len(large)))
+		assert.Equal(t, lr.meta.remotePath, remotePath)
+
+		conn := &fasthttp.RequestCtx{}
+		lr.Write(conn, log.Noop{})
+		body := request.Res(t, conn).
+			OK().
+			Header("Content-Type", "application/javascript").
+			Body
+		assert.Equal(t, body, large)
+
+		f, _ := up.store.Open(localPath)
+		meta, _ := MetaFromReader(up, f, true)
+		assert.True(t, meta.checksumMatches(f))
+		f.Close()
+	}
+
+	// our temp files were cleaned up
+	assertNoTempFiles(t, string(up.cacheRoot))
+}
+
+func Test_Upstream_MaxObjectSize(t *testing.T) {
+	large := strings.Repeat("0123456789", 1000)
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		if filepath.Ext(r.URL.Path) == ".png" {
+			w.Header().Set("Content-Type", "image/png")
+		}
+		switch r.URL.Path {
+		case "/small.js", "/small.txt":
+			w.Write([]byte("small"))
+		case "/chunked.js", "/chunked.png":
+			w.(gohttp.Flusher).Flush()
+			w.Write([]byte(large))
+		case "/small.png":
+			w.(gohttp.Flusher).Flush()
+			w.Write([]byte("small"))
+		default:
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+			w.Write([]byte(large))
+		}
+	}))
+	defer server.Close()
+
+	up := testDiskHTTPUpstream("up_max_size", server.URL)
+	up.maxObjectSizeDefault = 5000
+	up.maxObjectSizes = map[string]int64{".txt": 2, ".css": 0}
+	env := NewEnv(up)
+
+	for _, remotePath := range []string{"large.js", "chunked.js", "small.txt"} {
+		localPath := up.LocalResPath(remotePath, filepath.Ext(remotePath))
+		res, err := up.GetResponseAndSave(remotePath, localPath, env)
+		assert.Nil(t, err)
+		pt, passed := res.(*PassThroughResponse)
+		assert.True(t, passed)
+
+		conn := &fasthttp.RequestCtx{}
+		pt.Write(conn, log.Noop{})
+		body := request.Res(t, conn).
+			OK().
+			Header("X-Cache", "PASS").
+			Header("Content-Type", "application/javascript").
+			Body
+		if remotePath == "small.txt" {
+			assert.Equal(t, body, "small")
+		} else {
+			assert.Equal(t, body, large)
+		}
+		pt.Close()
+
+		// nothing was cached
+		assert.Nil(t, up.LoadLocalResponse(localPath, env, false))
+	}
+
+	// under the limit, or no limit for the extension
+	for _, remotePath := range []string{"small.js", "large.css"} {
+		localPath := up.LocalResPath(remotePath, filepath.Ext(remotePath))
+		res, err := up.GetResponseAndSave(remotePath, localPath, env)
+		assert.Nil(t, err)
+		_, passed := res.(*PassThroughResponse)
+		assert.False(t, passed)
+		if closer, ok := res.(io.Closer); ok {
+			closer.Close()
+		}
+		assert.NotNil(t, up.LoadLocalResponse(localPath, env, false))
+	}
+
+	// an image without a Content-Length, we only find out it's too large as
+	// we write it
+	metaPath, imagePath := up.LocalImagePath("chunked.png", ".png", nil)
+	res, expires, err := up.SaveOriginImage("chunked.png", metaPath, imagePath, env)
+	assert.Nil(t, err)
+	assert.Equal(t, expires, 0)
+	pt := res.(*PassThroughResponse)
+	conn := &fasthttp.RequestCtx{}
+	pt.Write(conn, log.Noop{})
+	body := request.Res(t, conn).
+		OK().
+		Header("X-Cache", "PASS").
+		Header("Content-Type", "image/png").
+		Body
+	assert.Equal(t, body, large)
+	pt.Close()
+	assert.False(t, fileExists(metaPath))
+	assert.False(t, fileExists(imagePath))
+
+	metaPath, imagePath = up.LocalImagePath("small.png", ".png", nil)
+	res, expires, err = up.SaveOriginImage("small.png", metaPath, imagePath, env)
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+	assert.True(t, expires > 0)
+	assert.Equal(t, readStoreFile(up.store, imagePath), "small")
+
+	assertNoTempFiles(t, string(up.cacheRoot))
+}
+
+// temp files are written next to their final name, so we have to look
+// through every shard
+func assertNoTempFiles(t *testing.T, root string) {
+	t.Helper()
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err == nil {
+			assert.False(t, isTempFile(info.Name()))
+		}
+		return nil
+	})
+}
+
+func Test_Upstream_RemotePath(t *testing.T) {
+	up := &Upstream{}
+	assert.Equal(t, up.RemotePath("app.js", "v=42"), "app.js")
+
+	up.queryParams = []string{"v", "lang"}
+	assert.Equal(t, up.RemotePath("app.js", ""), "app.js")
+	assert.Equal(t, up.RemotePath("app.js", "utm_source=x"), "app.js")
+	assert.Equal(t, up.RemotePath("app.js", "v=42"), "app.js?v=42")
+	assert.Equal(t, up.RemotePath("app.js", "v=42&utm_source=x&lang=en"), "app.js?lang=en&v=42")
+	assert.Equal(t, up.RemotePath("app.js", "lang=en&v=42"), "app.js?lang=en&v=42")
+	assert.Equal(t, up.RemotePath("app.js", "v=a%20b&v=c"), "app.js?v=a+b&v=c")
+
+	assert.Equal(t, remoteExtension("app.JS?v=1.2"), ".js")
+	assert.Equal(t, remoteExtension("img/tea.png"), ".png")
+}
+
+func Test_Upstream_QueryParams(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		received = append(received, r.URL.RawQuery)
+		w.Write([]byte(r.URL.Query().Get("v")))
+	}))
+	defer server.Close()
+
+	up := testHTTPUpstream("up_query", server.URL)
+	up.queryParams = []string{"v"}
+	env := NewEnv(up)
+
+	for _, v := range []string{"42", "43"} {
+		remotePath := up.RemotePath("app.js", "utm_source=x&v="+v)
+		assert.Equal(t, remotePath, "app.js?v="+v)
+
+		res, err := up.GetResponseAndSave(remotePath, up.LocalResPath(remotePath, ".js"), env)
+		assert.Nil(t, err)
+		res.(*RemoteResponse).Close()
+	}
+	assert.Equal(t, len(received), 2)
+	assert.Equal(t, received[0], "v=42")
+	assert.Equal(t, received[1], "v=43")
+
+	// each version has its own cache entry
+	for _, v := range []string{"42", "43"} {
+		remotePath := "app.js?v=" + v
+		lr := up.LoadLocalResponse(up.LocalResPath(remotePath, ".js"), env, false).(*LocalResponse)
+		assert.Equal(t, lr.meta.remotePath, remotePath)
+
+		conn := &fasthttp.RequestCtx{}
+		lr.Write(conn, log.Noop{})
+		assert.Equal(t, request.Res(t, conn).OK().Body, v)
+	}
+	assert.Nil(t, up.LoadLocalResponse(up.LocalResPath("app.js", ".js"), env, false))
+}
+
+// An upstream (with an in-memory store) for baseURL, usually an httptest server
+func testHTTPUpstream(name string, baseURL string) *Upstream {
+	return testHTTPUpstreamWith(name, baseURL, nil)
+}
+
+// Like testHTTPUpstream, but with an (emptied) disk store
+func testDiskHTTPUpstream(name string, baseURL string) *Upstream {
+	os.RemoveAll(upstreamCacheRoot(name))
+	return testHTTPUpstreamWith(name, baseURL, func(c *upstreamConfig) { c.Store = "disk" })
+}
+
+// configure, which can be nil, can change the config before the upstream is
+// created
+func testHTTPUpstreamWith(name string, baseURL string, configure func(c *upstreamConfig)) *Upstream {
+	config := &upstreamConfig{
+		Store:   "memory",
+		BaseURL: baseURL + "/",
+		Buffers: &buffer.Config{Count: 2, Min: 4096, Max: 4096},
+		Headers: []string{"ETag"},
+	}
+	if configure != nil {
+		configure(config)
+	}
+
+	up, err := NewUpstream(name, config)
+	if err != nil {
+		panic(err)
+	}
+	return up
+}
+
 func testUpstream2() *Upstream {
 	return testUpstream("up2_local")
 }
@@ -273,6 +1166,20 @@ func assertFileHash(t *testing.T, cachePath string, expected string) {
 	assert.Equal(t, actual, expected)
 }
 
+// flips the last byte of the file
+func corruptStoreFile(store Store, p string) {
+	data := []byte(readStoreFile(store, p))
+	data[len(data)-1] ^= 0xff
+	w, err := store.Create(p)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(data)
+	if err := w.Commit(); err != nil {
+		panic(err)
+	}
+}
+
 // This is a bit lame, but we modify our local file, so that we can
 // assert that the file is being served from the local cache, and not
 // being re-fetched from the upstream
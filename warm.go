@@ -0,0 +1,262 @@
+package assets
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"src.goblgobl.com/utils/http"
+)
+
+const (
+	WARM_CACHED   = "cached"
+	WARM_FETCHED  = "fetched"
+	WARM_FAILED   = "failed"
+	WARM_UNCACHED = "uncached" // fetched, but too large to cache (max_object_size)
+
+	DEFAULT_WARM_CONCURRENCY = 4
+	MAX_WARM_CONCURRENCY     = 64
+
+	// the most paths a single POST /warm can have, the list is processed
+	// within the request, so larger lists have to be sent in batches
+	MAX_WARM_PATHS = 1000
+)
+
+// The outcome of warming a single path (or one of its transforms)
+type WarmResult struct {
+	Path   string `json:"path"`
+	XForm  string `json:"xform,omitempty"`
+	Result string `json:"result"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type WarmSummary struct {
+	Total    int          `json:"total"`
+	Cached   int          `json:"cached"`
+	Fetched  int          `json:"fetched"`
+	Uncached int          `json:"uncached"`
+	Failed   int          `json:"failed"`
+	Failures []WarmResult `json:"failures"`
+}
+
+// What POST /warm responds with: the summary and the result of every path, in
+// the order they were done.
+type WarmResponse struct {
+	WarmSummary
+	Results []WarmResult `json:"results"`
+}
+
+// Makes sure every path is cached, fetching from the upstream exactly like a
+// client request would. For images, each of the named transforms is also
+// generated. progress (which can be nil) is called, from a single goroutine
+// at a time, as each path/transform is done.
+func (u *Upstream) Warm(paths []string, xforms []string, concurrency int, progress func(WarmResult)) (WarmSummary, error) {
+	for _, xform := range xforms {
+		if _, exists := u.transforms[xform]; !exists {
+			return WarmSummary{}, fmt.Errorf("unknown xform: %s", xform)
+		}
+	}
+
+	if concurrency < 1 {
+		concurrency = DEFAULT_WARM_CONCURRENCY
+	}
+
+	var lock sync.Mutex
+	summary := WarmSummary{Failures: []WarmResult{}}
+	report := func(result WarmResult) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		summary.Total += 1
+		switch result.Result {
+		case WARM_CACHED:
+			summary.Cached += 1
+		case WARM_FETCHED:
+			summary.Fetched += 1
+		case WARM_UNCACHED:
+			summary.Uncached += 1
+		default:
+			summary.Failed += 1
+			summary.Failures = append(summary.Failures, result)
+		}
+		if progress != nil {
+			progress(result)
+		}
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for remotePath := range queue {
+				u.warm(remotePath, xforms, report)
+			}
+		}()
+	}
+
+	for _, remotePath := range paths {
+		queue <- remotePath
+	}
+	close(queue)
+	wg.Wait()
+
+	return summary, nil
+}
+
+func (u *Upstream) warm(remotePath string, xforms []string, report func(WarmResult)) {
+	env := NewEnv(u)
+	defer env.Release()
+
+	extension := remoteExtension(remotePath)
+	if !isImageExtension(extension) {
+		res, err := loadStatic(env, remotePath, extension)
+		report(warmResult(remotePath, "", res, err))
+		return
+	}
+
+	res, err := loadImage(env, remotePath, extension, nil, nil)
+	result := warmResult(remotePath, "", res, err)
+	report(result)
+	if result.Result == WARM_FAILED {
+		// no origin, no point trying to transform it
+		return
+	}
+
+	for _, xform := range xforms {
+		res, err := loadImage(env, remotePath, extension, []byte(xform), u.transforms[xform])
+		report(warmResult(remotePath, xform, res, err))
+	}
+}
+
+// We don't need the response itself, only to know whether it came from our
+// cache and whether it was a success
+func warmResult(remotePath string, xform string, res http.Response, err error) WarmResult {
+	result := WarmResult{Path: remotePath, XForm: xform, Result: WARM_FETCHED}
+	if err != nil {
+		result.Result = WARM_FAILED
+		result.Error = err.Error()
+		return result
+	}
+
+	switch r := res.(type) {
+	case *LocalResponse:
+		r.Close()
+		result.Status = int(r.meta.status)
+		if r.hit {
+			result.Result = WARM_CACHED
+		}
+	case *RemoteResponse:
+		r.Close()
+		result.Status = int(r.meta.status)
+	case *PassThroughResponse:
+		// closes the upstream's body, we don't want the rest of it
+		r.Close()
+		result.Status = int(r.meta.status)
+		if result.Status < 400 {
+			result.Result = WARM_UNCACHED
+		}
+	default:
+		// the only static response these flows return is our cached 404
+		result.Status = 404
+	}
+
+	if result.Status >= 400 {
+		result.Result = WARM_FAILED
+	}
+	return result
+}
+
+// Paths to warm, either one per line (blank lines and lines starting with #
+// are ignored) or a sitemap. Entries can be full URLs, in which case the
+// upstream's base_url(s) or our own /v1/ prefix is stripped. Query strings
+// are filtered and normalized the same as a request's (see RemotePath).
+func (u *Upstream) ParseWarmList(r io.Reader) ([]string, error) {
+	baseURLs := []string{u.baseURL}
+	if u.hosts != nil {
+		baseURLs = u.hosts.URLs()
+	}
+
+	entries, err := ReadWarmList(r)
+	paths := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if p := warmPath(entry, baseURLs); p != "" {
+			requestPath, rawQuery, _ := strings.Cut(p, "?")
+			paths = append(paths, u.RemotePath(requestPath, rawQuery))
+		}
+	}
+	return paths, err
+}
+
+// The entries of a warm list (see ParseWarmList) as-is, for when they're
+// going to be sent to a node's POST /warm
+func ReadWarmList(r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+	peek, _ := br.Peek(512)
+	if bytes.HasPrefix(bytes.TrimSpace(peek), []byte("<")) {
+		return readSitemap(br)
+	}
+
+	var entries []string
+	scanner := bufio.NewScanner(br)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
+
+func readSitemap(r io.Reader) ([]string, error) {
+	var sitemap struct {
+		URLs []struct {
+			Loc string `xml:"loc"`
+		} `xml:"url"`
+	}
+	if err := xml.NewDecoder(r).Decode(&sitemap); err != nil {
+		return nil, err
+	}
+	if len(sitemap.URLs) == 0 {
+		return nil, errors.New("sitemap has no <url> entries")
+	}
+
+	entries := make([]string, 0, len(sitemap.URLs))
+	for _, u := range sitemap.URLs {
+		if loc := strings.TrimSpace(u.Loc); loc != "" {
+			entries = append(entries, loc)
+		}
+	}
+	return entries, nil
+}
+
+func warmPath(entry string, baseURLs []string) string {
+	for _, baseURL := range baseURLs {
+		if baseURL != "" && strings.HasPrefix(entry, baseURL) {
+			return entry[len(baseURL):]
+		}
+	}
+
+	if strings.Contains(entry, "://") {
+		parsed, err := url.Parse(entry)
+		if err != nil {
+			return ""
+		}
+		entry = parsed.Path
+		if parsed.RawQuery != "" {
+			entry += "?" + parsed.RawQuery
+		}
+	}
+
+	entry = strings.TrimPrefix(entry, "/")
+	return strings.TrimPrefix(entry, "v1/")
+}
@@ -0,0 +1,101 @@
+package assets
+
+import (
+	gohttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_Upstream_ParseWarmList_Lines(t *testing.T) {
+	u := &Upstream{baseURL: "https://www.goblgobl.com/docs/"}
+	paths, err := u.ParseWarmList(strings.NewReader(`
+# comment
+main.css
+  /images/tea.png
+https://www.goblgobl.com/docs/js/app.js
+https://assets.goblgobl.com/v1/images/cup.png?up=docs
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, len(paths), 4)
+	assert.Equal(t, paths[0], "main.css")
+	assert.Equal(t, paths[1], "images/tea.png")
+	assert.Equal(t, paths[2], "js/app.js")
+	assert.Equal(t, paths[3], "images/cup.png")
+}
+
+func Test_Upstream_ParseWarmList_Sitemap(t *testing.T) {
+	u := &Upstream{baseURL: "https://www.goblgobl.com/docs/"}
+	paths, err := u.ParseWarmList(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>https://www.goblgobl.com/docs/main.css</loc></url>
+	<url><loc> https://assets.goblgobl.com/v1/tea.png </loc><lastmod>2023-01-01</lastmod></url>
+</urlset>`))
+	assert.Nil(t, err)
+	assert.Equal(t, len(paths), 2)
+	assert.Equal(t, paths[0], "main.css")
+	assert.Equal(t, paths[1], "tea.png")
+
+	_, err = u.ParseWarmList(strings.NewReader(`<urlset></urlset>`))
+	assert.NotNil(t, err)
+}
+
+func Test_Upstream_ParseWarmList_Query(t *testing.T) {
+	u := &Upstream{baseURL: "https://www.goblgobl.com/docs/", queryParams: []string{"v"}}
+	paths, err := u.ParseWarmList(strings.NewReader(`
+main.css?v=2&utm_source=x
+https://www.goblgobl.com/docs/js/app.js?v=3
+https://assets.goblgobl.com/v1/images/cup.png?up=docs&v=4
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, len(paths), 3)
+	assert.Equal(t, paths[0], "main.css?v=2")
+	assert.Equal(t, paths[1], "js/app.js?v=3")
+	assert.Equal(t, paths[2], "images/cup.png?v=4")
+}
+
+func Test_Upstream_Warm_UnknownXForm(t *testing.T) {
+	up := testUpstream2()
+	_, err := up.Warm([]string{"tea.png"}, []string{"nope"}, 1, nil)
+	assert.Equal(t, err.Error(), "unknown xform: nope")
+}
+
+func Test_Upstream_Warm_Cached(t *testing.T) {
+	up := testUpstream2()
+	env := NewEnv(up)
+	writeLocal(env, "warm/1.css", BuildRemoteResponse().Body("1").Response())
+	writeLocal(env, "warm/2.css", BuildRemoteResponse().Body("2").Response())
+	writeLocal(env, "warm/3.css", BuildRemoteResponse().Body("3").Status(404).Response())
+
+	progress := 0
+	summary, err := up.Warm([]string{"warm/1.css", "warm/2.css", "warm/3.css"}, nil, 2, func(result WarmResult) {
+		progress += 1
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, progress, 3)
+	assert.Equal(t, summary.Total, 3)
+	assert.Equal(t, summary.Cached, 2)
+	assert.Equal(t, summary.Fetched, 0)
+	assert.Equal(t, summary.Failed, 1)
+	assert.Equal(t, summary.Failures[0].Path, "warm/3.css")
+	assert.Equal(t, summary.Failures[0].Status, 404)
+}
+
+func Test_Upstream_Warm_TooLarge(t *testing.T) {
+	server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.Write([]byte(strings.Repeat("a", 100)))
+	}))
+	defer server.Close()
+
+	up := testHTTPUpstream("up_warm_large", server.URL)
+	up.maxObjectSizeDefault = 10
+
+	summary, err := up.Warm([]string{"large.css"}, nil, 1, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, summary.Total, 1)
+	assert.Equal(t, summary.Uncached, 1)
+	assert.Equal(t, summary.Failed, 0)
+	assert.Nil(t, up.LoadLocalResponse(up.LocalResPath("large.css", ".css"), NewEnv(up), false))
+}